@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"pipeline/data"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how long an agent waits before trying to register again, when the server can't be reached
+const AGENT_RETRY_DELAY = 5 * time.Second
+
+// how often an agent sends the output of the commands it's running to the server
+const AGENT_OUTPUT_INTERVAL = 500 * time.Millisecond
+
+// how long an agent's requests (other than polling for a job) can take
+const AGENT_REQUEST_TIMEOUT = 30 * time.Second
+
+type agentConfig struct {
+	server  string // the url of the server e.g. http://ci:8080
+	name    string
+	labels  []string
+	maxJobs int // how many jobs it runs at once
+	token   string
+}
+
+// an agent registered with the server, the session ends when the server doesn't know it anymore
+type agentSession struct {
+	config agentConfig
+	id     string
+	client *http.Client
+	logger *logrus.Logger
+
+	mutex   sync.Mutex
+	running map[string]process // the commands of the jobs it's running, by job id
+}
+
+func startAgent(logger *logrus.Logger, args []string) {
+	hostname, _ := os.Hostname()
+
+	agentCmd := flag.NewFlagSet("agent", flag.ContinueOnError)
+	server := agentCmd.String("server", os.Getenv("PIPELINE_SERVER"), "url of the server to run stages for")
+	name := agentCmd.String("name", hostname, "name of the agent")
+	labels := agentCmd.String("labels", "", "comma separated labels of the agent, stages with runs_on run on agents with all of theirs")
+	maxJobs := agentCmd.Int("max-jobs", 1, "max jobs running at once")
+	agentCmd.Parse(args[2:])
+
+	if *server == "" {
+		logger.Error("Missing -server (or PIPELINE_SERVER environment variable)")
+		return
+	}
+	if *maxJobs < 1 {
+		logger.Error("Invalid -max-jobs, must be at least 1")
+		return
+	}
+	var config = agentConfig{server: strings.TrimSuffix(*server, "/"), name: *name, maxJobs: *maxJobs, token: os.Getenv("AGENT_TOKEN")}
+	for _, label := range strings.Split(*labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			config.labels = append(config.labels, label)
+		}
+	}
+
+	// Ctrl-C (or being asked to terminate) stops the jobs it's running, and they are reported as such
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Running as agent " + config.name + " for " + config.server)
+	runAgent(ctx, config, logger)
+}
+
+// runAgent registers with the server and runs the jobs it's given until ctx is cancelled, registering again
+// whenever the server stops knowing about it
+func runAgent(ctx context.Context, config agentConfig, logger *logrus.Logger) {
+	var client = &http.Client{}
+	for ctx.Err() == nil {
+		var session = &agentSession{config: config, client: client, logger: logger, running: make(map[string]process)}
+		var registered data.AgentRegistered
+		status, err := session.request(ctx, "POST", "/api/agents", data.AgentRegistration{Name: config.name, Labels: config.labels}, &registered)
+		if err == nil && status != 200 {
+			err = errors.New("status " + strconv.Itoa(status))
+		}
+		if err != nil {
+			logger.Error("Unable to register with the server: " + err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(AGENT_RETRY_DELAY):
+			}
+			continue
+		}
+		session.id = registered.Id
+		logger.Info("Registered with the server as " + session.id)
+
+		session.run(ctx, time.Duration(registered.HeartbeatIntervalMs)*time.Millisecond)
+	}
+}
+
+// run sends heartbeats and runs jobs until ctx is cancelled or the server doesn't know the agent anymore
+func (s *agentSession) run(ctx context.Context, heartbeatInterval time.Duration) {
+	sessionCtx, endSession := context.WithCancel(ctx)
+	defer endSession()
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.config.maxJobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for sessionCtx.Err() == nil {
+				var job data.AgentJob
+				status, err := s.request(sessionCtx, "GET", "/api/agents/"+s.id+"/jobs", nil, &job)
+				switch {
+				case err != nil:
+					if sessionCtx.Err() == nil {
+						s.logger.Error("Unable to poll for jobs: " + err.Error())
+						time.Sleep(AGENT_RETRY_DELAY)
+					}
+				case status == 404:
+					endSession()
+				case status == 200:
+					s.runJob(sessionCtx, job)
+				}
+			}
+		}()
+	}
+
+	// keep sending heartbeats while the jobs that are running finish
+	var workersDone = make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	var ticker = time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-workersDone:
+			return
+		case <-ticker.C:
+		}
+
+		var response data.AgentHeartbeatResponse
+		// still sent while it's stopping, the jobs it's running could need to be killed
+		status, err := s.request(context.Background(), "POST", "/api/agents/"+s.id+"/heartbeat", nil, &response)
+		if err != nil {
+			s.logger.Error("Unable to send a heartbeat: " + err.Error())
+			continue
+		}
+		if status == 404 {
+			s.logger.Warn("The server doesn't know this agent anymore, stopping its jobs")
+			endSession()
+		}
+		for _, jobId := range response.Terminate {
+			s.stopJob(jobId, false)
+		}
+		for _, jobId := range response.Kill {
+			s.stopJob(jobId, true)
+		}
+	}
+}
+
+func (s *agentSession) stopJob(jobId string, kill bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if process := s.running[jobId]; process != nil {
+		if kill {
+			process.kill()
+		} else {
+			process.terminate()
+		}
+	}
+}
+
+// runJob runs the command of a job like the server would, streaming its output (and then how it exited) back.
+// It's stopped when ctx is cancelled, or the server no longer has the job
+func (s *agentSession) runJob(ctx context.Context, job data.AgentJob) {
+	var jobPath = "/api/agents/" + s.id + "/jobs/" + job.Id
+	s.logger.Info("Running " + job.Pipeline + "/" + job.Stage)
+
+	// the outputs it writes to PIPELINE_OUTPUT are sent once it exits, as ::set-output lines
+	outputFile, err := os.CreateTemp("", "pipeline-output-*")
+	if err != nil {
+		s.sendExit(jobPath, processExit{exitCode: -1, err: err})
+		return
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	var env = append(append(os.Environ(), job.Env...), "PIPELINE_OUTPUT="+outputFile.Name())
+	var stage = data.Stage{Name: job.Stage, Task: job.Task, Args: job.Args, Shell: job.Shell, Pwd: job.Pwd}
+	process, err := localExecutor{}.start(stage, env)
+	if err != nil {
+		s.sendExit(jobPath, processExit{exitCode: -1, err: err})
+		return
+	}
+	s.mutex.Lock()
+	s.running[job.Id] = process
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.running, job.Id)
+		s.mutex.Unlock()
+	}()
+
+	stopped := func() { process.kill() }
+	if status, err := s.request(ctx, "POST", jobPath+"/start", nil, nil); err == nil && status == 404 {
+		stopped()
+	}
+	var done = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			process.terminate()
+		case <-done:
+			return
+		}
+		select {
+		case <-time.After(TERMINATE_GRACE_PERIOD):
+			process.kill()
+		case <-done:
+		}
+	}()
+
+	var output = &agentOutput{session: s, path: jobPath, stopped: stopped}
+	var flushDone = make(chan struct{})
+	go func() {
+		defer close(flushDone)
+		var ticker = time.NewTicker(AGENT_OUTPUT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				output.flush()
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for _, reader := range []io.Reader{process.stdout(), process.stderr()} {
+		readers.Add(1)
+		go func(reader io.Reader) {
+			defer readers.Done()
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				output.write(scanner.Text() + "\n")
+			}
+		}(reader)
+	}
+	readers.Wait()
+	var exit = process.wait()
+	close(done)
+	<-flushDone
+
+	if outputFileData, err := os.ReadFile(outputFile.Name()); err == nil {
+		for _, line := range strings.Split(string(outputFileData), "\n") {
+			if line != "" {
+				output.write(OUTPUT_MARKER + line + "\n")
+			}
+		}
+	}
+	output.flush()
+	s.sendExit(jobPath, exit)
+}
+
+func (s *agentSession) sendExit(jobPath string, exit processExit) {
+	var jobExit = data.AgentJobExit{ExitCode: exit.exitCode, Signal: exit.signal, Usage: exit.usage}
+	if exit.err != nil {
+		jobExit.Error = exit.err.Error()
+	}
+	// sent even when the agent is stopping, so the server doesn't have to wait for it to be lost
+	if _, err := s.request(context.Background(), "POST", jobPath+"/exit", jobExit, nil); err != nil {
+		s.logger.Error("Unable to send how a job exited: " + err.Error())
+	}
+}
+
+// the output of a job's command that hasn't been sent to the server yet
+type agentOutput struct {
+	session *agentSession
+	path    string
+	stopped func() // called when the server no longer has the job
+	mutex   sync.Mutex
+	buffer  bytes.Buffer
+}
+
+func (o *agentOutput) write(line string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.buffer.WriteString(line)
+}
+
+func (o *agentOutput) flush() {
+	o.mutex.Lock()
+	var chunk = bytes.Clone(o.buffer.Bytes())
+	o.buffer.Reset()
+	o.mutex.Unlock()
+	if len(chunk) == 0 {
+		return
+	}
+
+	status, err := o.session.request(context.Background(), "POST", o.path+"/output", chunk, nil)
+	if err != nil {
+		o.session.logger.Error("Unable to send a job's output: " + err.Error())
+	} else if status == 404 {
+		o.stopped()
+	}
+}
+
+// request sends a request to the server, body is sent as is if it's []byte, as json otherwise. The response is
+// decoded into response (if not nil) when it's successful. Returns the response's status code
+func (s *agentSession) request(ctx context.Context, method string, path string, body any, response any) (int, error) {
+	var bodyReader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		bodyReader = bytes.NewReader(body)
+	default:
+		bodyJson, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		bodyReader = bytes.NewReader(bodyJson)
+	}
+
+	// polling for a job is held open by the server for up to AGENT_POLL_TIMEOUT
+	var timeout = AGENT_REQUEST_TIMEOUT
+	if method == "GET" {
+		timeout += AGENT_POLL_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, method, s.config.server+path, bodyReader)
+	if err != nil {
+		return 0, err
+	}
+	if s.config.token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.config.token)
+	}
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return resp.StatusCode, errors.New("the server refused the agent's token, check AGENT_TOKEN")
+	}
+	if response != nil && resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
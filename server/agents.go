@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"pipeline/data"
+	"pipeline/utils"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Agents are other hosts running `pipeline agent`, they register with the server and run the tasks of stages with
+// runs_on for it. Each command (a task, or one of its steps) is queued as a job, and picked up by the first agent
+// polling for one that has all of the stage's labels. The agent streams the command's output back as it runs, then
+// how it exited. An agent that misses AGENT_MISSED_HEARTBEATS heartbeats is considered gone: the jobs it hadn't
+// started yet are queued again for another agent, the ones it was running fail (and can be retried). A job an agent
+// doesn't start within as long (e.g. the response giving it the job was lost) is queued again too.
+
+const AGENT_HEARTBEAT_INTERVAL = 5 * time.Second
+const AGENT_MISSED_HEARTBEATS = 3
+
+// how long an agent's poll for a job is held open when there isn't one for it yet
+const AGENT_POLL_TIMEOUT = 25 * time.Second
+
+type registeredAgent struct {
+	id       string
+	name     string
+	labels   []string
+	lastSeen time.Time
+}
+
+type agentJob struct {
+	job      data.AgentJob
+	labels   []string
+	agent    *registeredAgent // nil while it's queued
+	assigned time.Time        // when the agent was given it
+	started  bool             // the agent has started its command
+	stop     string           // "terminate" or "kill" once it has been asked to stop, sent to the agent with its heartbeats
+	output   *io.PipeWriter   // the output the agent sends is read from the other end
+	exit     processExit
+	exited   chan struct{}
+}
+
+type agentRegistry struct {
+	mutex  sync.Mutex
+	agents map[string]*registeredAgent
+	jobs   map[string]*agentJob // the jobs that haven't exited yet, by id
+	queue  []*agentJob          // the jobs no agent has picked up, oldest first
+	// closed (and replaced) when jobs are queued, to wake the agents polling for one
+	queued            chan struct{}
+	heartbeatInterval time.Duration
+	serving           bool
+}
+
+var Agents = &agentRegistry{
+	agents:            make(map[string]*registeredAgent),
+	jobs:              make(map[string]*agentJob),
+	queued:            make(chan struct{}),
+	heartbeatInterval: AGENT_HEARTBEAT_INTERVAL,
+}
+
+// serve starts looking for agents that stopped sending heartbeats. Until it's called (e.g. running headless) there
+// can't be any agents, so stages with runs_on fail to start instead of waiting for one forever.
+func (r *agentRegistry) serve(logger *logrus.Logger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.serving {
+		return
+	}
+	r.serving = true
+	// the jobs agents are given carry the stages' env, secrets included
+	if os.Getenv("AGENT_TOKEN") == "" {
+		logger.Warn("AGENT_TOKEN isn't set: anyone who can reach the server can register as an agent, and be given the env (secrets included) of stages with runs_on")
+	}
+
+	go func() {
+		for {
+			r.mutex.Lock()
+			var interval = r.heartbeatInterval
+			r.mutex.Unlock()
+			time.Sleep(interval / 2)
+			r.removeLostAgents()
+			r.requeueUnstartedJobs()
+		}
+	}()
+}
+
+func (r *agentRegistry) isServing() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.serving
+}
+
+func (r *agentRegistry) register(registration data.AgentRegistration) data.AgentRegistered {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var agent = &registeredAgent{id: utils.GenerateId(), name: registration.Name, labels: registration.Labels, lastSeen: time.Now()}
+	r.agents[agent.id] = agent
+	return data.AgentRegistered{Id: agent.id, HeartbeatIntervalMs: r.heartbeatInterval.Milliseconds()}
+}
+
+// seen returns the agent with id, and records that it's still there. nil if it isn't registered (anymore)
+func (r *agentRegistry) seen(id string) *registeredAgent {
+	var agent = r.agents[id]
+	if agent != nil {
+		agent.lastSeen = time.Now()
+	}
+	return agent
+}
+
+// heartbeat returns the jobs the agent has to stop, false if the agent isn't registered and has to register again
+func (r *agentRegistry) heartbeat(id string) (data.AgentHeartbeatResponse, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var response data.AgentHeartbeatResponse
+	var agent = r.seen(id)
+	if agent == nil {
+		return response, false
+	}
+	for jobId, job := range r.jobs {
+		if job.agent != agent {
+			continue
+		}
+		switch job.stop {
+		case "terminate":
+			response.Terminate = append(response.Terminate, jobId)
+		case "kill":
+			response.Kill = append(response.Kill, jobId)
+		}
+	}
+	return response, true
+}
+
+// poll waits for a job the agent can run, until ctx is done or AGENT_POLL_TIMEOUT. Returns nil if there wasn't one,
+// false if the agent isn't registered. The agent has to start the job it's given, or it's queued again
+func (r *agentRegistry) poll(ctx context.Context, id string) (*data.AgentJob, bool) {
+	var timeout = time.NewTimer(AGENT_POLL_TIMEOUT)
+	defer timeout.Stop()
+
+	for {
+		r.mutex.Lock()
+		var agent = r.seen(id)
+		if agent == nil {
+			r.mutex.Unlock()
+			return nil, false
+		}
+		// nothing could be returned to an agent that's gone
+		if ctx.Err() != nil {
+			r.mutex.Unlock()
+			return nil, true
+		}
+		for i, job := range r.queue {
+			if hasLabels(agent.labels, job.labels) {
+				r.queue = slices.Delete(r.queue, i, i+1)
+				job.agent, job.assigned = agent, time.Now()
+				r.mutex.Unlock()
+				return &job.job, true
+			}
+		}
+		var queued = r.queued
+		r.mutex.Unlock()
+
+		select {
+		case <-queued:
+		case <-ctx.Done():
+			return nil, true
+		case <-timeout.C:
+			return nil, true
+		}
+	}
+}
+
+// hasLabels reports whether an agent with labels can run the jobs of stages that run on wanted
+func hasLabels(labels []string, wanted []string) bool {
+	for _, label := range wanted {
+		if !slices.Contains(labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// job returns the job with jobId if the agent with id was given it, and records that the agent is still there
+func (r *agentRegistry) job(id string, jobId string) *agentJob {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var agent = r.seen(id)
+	var job = r.jobs[jobId]
+	if agent == nil || job == nil || job.agent != agent {
+		return nil
+	}
+	return job
+}
+
+func (r *agentRegistry) start(id string, jobId string) bool {
+	var job = r.job(id, jobId)
+	if job == nil {
+		return false
+	}
+	r.mutex.Lock()
+	job.started = true
+	r.mutex.Unlock()
+	return true
+}
+
+// requeue queues a job the agent was given again, when it couldn't be returned to it
+func (r *agentRegistry) requeue(id string, jobId string) {
+	var job = r.job(id, jobId)
+	if job == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.unassign(job)
+}
+
+// writeOutput passes output the agent sent on to the job's log. Blocks until it has been read
+func (r *agentRegistry) writeOutput(id string, jobId string, output []byte) bool {
+	var job = r.job(id, jobId)
+	if job == nil {
+		return false
+	}
+	_, err := job.output.Write(output)
+	return err == nil
+}
+
+func (r *agentRegistry) exited(id string, jobId string, jobExit data.AgentJobExit) bool {
+	var job = r.job(id, jobId)
+	if job == nil {
+		return false
+	}
+	var exit = processExit{exitCode: jobExit.ExitCode, signal: jobExit.Signal, usage: jobExit.Usage}
+	if jobExit.Error != "" {
+		exit.err = errors.New(jobExit.Error)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.finish(job, exit)
+	return true
+}
+
+// queueJob queues a job for an agent with all of labels, the output the agent sends is read from the reader returned
+func (r *agentRegistry) queueJob(job data.AgentJob, labels []string) (*agentJob, io.Reader) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var reader, writer = io.Pipe()
+	var queuedJob = &agentJob{job: job, labels: labels, output: writer, exited: make(chan struct{})}
+	r.jobs[job.Id] = queuedJob
+	r.enqueue(queuedJob)
+	return queuedJob, reader
+}
+
+func (r *agentRegistry) enqueue(job *agentJob) {
+	job.agent, job.started = nil, false
+	r.queue = append(r.queue, job)
+	close(r.queued)
+	r.queued = make(chan struct{})
+}
+
+// unassign takes back a job its agent hasn't started: it's queued again, or done if it was stopped in the meantime.
+// The registry's mutex has to be held
+func (r *agentRegistry) unassign(job *agentJob) {
+	if job.started || r.jobs[job.job.Id] != job {
+		return
+	}
+	if job.stop != "" {
+		r.finish(job, processExit{exitCode: -1, err: errors.New("stopped before an agent picked it up")})
+		return
+	}
+	r.enqueue(job)
+}
+
+// finish records how a job exited and ends its output, the registry's mutex has to be held
+func (r *agentRegistry) finish(job *agentJob, exit processExit) {
+	if _, ok := r.jobs[job.job.Id]; !ok {
+		return
+	}
+	delete(r.jobs, job.job.Id)
+	if i := slices.Index(r.queue, job); i >= 0 {
+		r.queue = slices.Delete(r.queue, i, i+1)
+	}
+
+	if job.agent != nil {
+		exit.agent = job.agent.name
+	}
+	job.exit = exit
+	job.output.Close()
+	close(job.exited)
+}
+
+// stop asks the agent running a job to stop its command, how is "terminate" or "kill". A job no agent has picked up
+// is done right away
+func (r *agentRegistry) stop(job *agentJob, how string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if job.agent == nil {
+		r.finish(job, processExit{exitCode: -1, err: errors.New("stopped before an agent picked it up")})
+		return
+	}
+	if job.stop != "kill" {
+		job.stop = how
+	}
+}
+
+// removeLostAgents forgets the agents that missed too many heartbeats. The jobs they were given but hadn't started
+// go back in the queue, the ones they had started fail
+func (r *agentRegistry) removeLostAgents() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var lostAfter = r.heartbeatInterval * AGENT_MISSED_HEARTBEATS
+	for id, agent := range r.agents {
+		if time.Since(agent.lastSeen) < lostAfter {
+			continue
+		}
+		delete(r.agents, id)
+
+		for _, job := range r.jobs {
+			if job.agent != agent {
+				continue
+			}
+			if !job.started && job.stop == "" {
+				r.enqueue(job)
+			} else {
+				r.finish(job, processExit{exitCode: -1, failureReason: data.FailureReason["AGENT_LOST"],
+					err: errors.New("agent '" + agent.name + "' stopped sending heartbeats")})
+			}
+		}
+	}
+}
+
+// requeueUnstartedJobs takes back the jobs agents were given but haven't started in time, e.g. because the response
+// giving them the job was lost. An agent starting one late is told it doesn't have it anymore
+func (r *agentRegistry) requeueUnstartedJobs() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var startTimeout = r.heartbeatInterval * AGENT_MISSED_HEARTBEATS
+	for _, job := range r.jobs {
+		if job.agent != nil && !job.started && time.Since(job.assigned) >= startTimeout {
+			r.unassign(job)
+		}
+	}
+}
+
+func (r *agentRegistry) list() []data.AgentResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var agents = make([]data.AgentResponse, 0, len(r.agents))
+	for _, agent := range r.agents {
+		var response = data.AgentResponse{Id: agent.id, Name: agent.name, Labels: agent.labels, LastSeen: agent.lastSeen, Jobs: []string{}}
+		for _, job := range r.jobs {
+			if job.agent == agent {
+				response.Jobs = append(response.Jobs, job.job.Pipeline+"/"+job.job.Stage)
+			}
+		}
+		agents = append(agents, response)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// runs tasks on an agent that has all of the stage's runs_on labels, see agentRegistry
+type agentExecutor struct {
+	pipelineName string
+}
+
+type agentProcess struct {
+	job    *agentJob
+	output io.Reader
+}
+
+func (e agentExecutor) start(stage data.Stage, env []string) (process, error) {
+	if !Agents.isServing() {
+		return nil, errors.New("stages with runs_on need the server, agents register with it")
+	}
+
+	// the agent has its own output file
+	env = slices.DeleteFunc(slices.Clone(env), func(entry string) bool { return strings.HasPrefix(entry, "PIPELINE_OUTPUT=") })
+	var job = data.AgentJob{Id: utils.GenerateId(), Pipeline: e.pipelineName, Stage: stage.Name, Task: stage.Task,
+		Args: stage.Args, Shell: stage.Shell, Pwd: stage.Pwd, Env: env}
+
+	var queuedJob, output = Agents.queueJob(job, stage.RunsOn)
+	var waiting = "waiting for an agent with labels: " + strings.Join(stage.RunsOn, ", ") + "\n"
+	return &agentProcess{job: queuedJob, output: io.MultiReader(strings.NewReader(waiting), output)}, nil
+}
+
+func (p *agentProcess) stdout() io.Reader { return p.output }
+func (p *agentProcess) stderr() io.Reader { return strings.NewReader("") }
+func (p *agentProcess) terminate() error  { Agents.stop(p.job, "terminate"); return nil }
+func (p *agentProcess) kill() error       { Agents.stop(p.job, "kill"); return nil }
+
+func (p *agentProcess) wait() processExit {
+	<-p.job.exited
+	return p.job.exit
+}
+
+// agentAuth requires AGENT_TOKEN (when it's set) as a bearer token, from agents and anyone listing them
+func agentAuth(c *gin.Context) {
+	var token = os.Getenv("AGENT_TOKEN")
+	if token != "" && c.GetHeader("Authorization") != "Bearer "+token {
+		c.AbortWithStatusJSON(401, data.ApiErrorResponse{Message: "invalid agent token"})
+	}
+}
+
+func defineAgentRoutes(router *gin.Engine, logger *logrus.Logger) {
+	const agents = "/api/agents"
+	const job = agents + "/:id/jobs/:job"
+
+	var agentRouter = router.Group("", agentAuth)
+
+	// return the agents that are registered
+	agentRouter.GET(agents, func(c *gin.Context) {
+		c.JSON(200, Agents.list())
+	})
+
+	// register an agent, it's given an id to send with the rest of its requests
+	agentRouter.POST(agents, func(c *gin.Context) {
+		var registration data.AgentRegistration
+		if err := c.ShouldBindJSON(&registration); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if registration.Name == "" {
+			c.JSON(400, data.ApiErrorResponse{Message: "an agent needs a name"})
+			return
+		}
+		logger.Info("Agent registered: " + registration.Name + " with labels: " + strings.Join(registration.Labels, ", "))
+		c.JSON(200, Agents.register(registration))
+	})
+
+	// an agent unknown to the server (e.g. after it restarted, or missed too many heartbeats) has to register again
+	agentRouter.POST(agents+"/:id/heartbeat", func(c *gin.Context) {
+		response, ok := Agents.heartbeat(c.Param("id"))
+		if !ok {
+			c.JSON(404, data.ApiErrorResponse{Message: "agent not registered"})
+			return
+		}
+		c.JSON(200, response)
+	})
+
+	// wait for the next job the agent can run, no content if there wasn't one in time
+	agentRouter.GET(agents+"/:id/jobs", func(c *gin.Context) {
+		job, ok := Agents.poll(c.Request.Context(), c.Param("id"))
+		if !ok {
+			c.JSON(404, data.ApiErrorResponse{Message: "agent not registered"})
+			return
+		}
+		if job == nil {
+			c.Status(204)
+			return
+		}
+		c.JSON(200, job)
+		c.Writer.Flush()
+		// the agent went away before it got the job
+		if c.Request.Context().Err() != nil {
+			Agents.requeue(c.Param("id"), job.Id)
+		}
+	})
+
+	// a job that isn't found was stopped, or given to another agent, the agent has to stop running it
+	agentRouter.POST(job+"/start", func(c *gin.Context) {
+		if !Agents.start(c.Param("id"), c.Param("job")) {
+			c.JSON(404, data.ApiErrorResponse{Message: "job not found"})
+			return
+		}
+		c.Status(204)
+	})
+
+	// the body is a chunk of the job's output, as is
+	agentRouter.POST(job+"/output", func(c *gin.Context) {
+		output, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !Agents.writeOutput(c.Param("id"), c.Param("job"), output) {
+			c.JSON(404, data.ApiErrorResponse{Message: "job not found"})
+			return
+		}
+		c.Status(204)
+	})
+
+	agentRouter.POST(job+"/exit", func(c *gin.Context) {
+		var exit data.AgentJobExit
+		if err := c.ShouldBindJSON(&exit); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !Agents.exited(c.Param("id"), c.Param("job"), exit) {
+			c.JSON(404, data.ApiErrorResponse{Message: "job not found"})
+			return
+		}
+		c.Status(204)
+	})
+}
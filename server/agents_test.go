@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"pipeline/data"
+	"pipeline/utils"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testAgentsPipeline = "test_assets/test_pipeline_agents_%s.json"
+
+// agentHelper starts a server with the agent routes, and an agent with labels registered with it that runs the jobs
+// it's given. Both are stopped when the test is done
+func agentHelper(t *testing.T, name string, labels []string) {
+	Agents.serve(testLogger)
+	gin.SetMode(gin.TestMode)
+	var router = gin.New()
+	defineAgentRoutes(router, testLogger)
+	var server = httptest.NewServer(router)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stopped = make(chan struct{})
+	go func() {
+		runAgent(ctx, agentConfig{server: server.URL, name: name, labels: labels, maxJobs: 4}, testLogger)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+		server.Close()
+	})
+}
+
+func Test_runPipeline_ShouldRunStagesWithRunsOnOnAnAgentWithTheirLabels(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	agentHelper(t, "test-agent", []string{"test_gpu", "test_linux"})
+	var pipeline data.Pipeline = pipelineLoadHelper(testAgentsPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	// the output, env and outputs of the task come back like they do for a local one
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["on_agent"].Status)
+	utils.AssertStringEqual(t, "test-agent", taskMap["on_agent"].Attempts[0].Agent)
+	utils.AssertStringEqual(t, "yes", taskMap["on_agent"].Outputs["built"])
+	utils.AssertTrue(t, taskMap["on_agent"].Usage != nil)
+	var logData, _ = os.ReadFile(taskMap["on_agent"].Attempts[0].LogFile)
+	utils.AssertTrue(t, strings.HasPrefix(string(logData), "waiting for an agent with labels: test_gpu\n"))
+	utils.AssertTrue(t, strings.Contains(string(logData), "mode=fast\n"))
+	utils.AssertTrue(t, strings.Contains(string(logData), "oops\n"))
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["uses_output"].Status)
+	logData, _ = os.ReadFile(taskMap["uses_output"].Attempts[0].LogFile)
+	utils.AssertStringEqual(t, "waiting for an agent with labels: test_gpu, test_linux\ngot yes\n", string(logData))
+
+	utils.AssertStringEqual(t, data.FailureReason["NON_ZERO_EXIT"], taskMap["exit_code"].FailureReason)
+	utils.AssertEqual(t, 3, taskMap["exit_code"].ExitCode)
+	utils.AssertStringEqual(t, "exit status 3", taskMap["exit_code"].Error)
+
+	// no agent has every label, so it waits until it times out
+	utils.AssertStringEqual(t, data.StageStatus["TIMED_OUT"], taskMap["no_agent"].Status)
+	utils.AssertStringEqual(t, "", taskMap["no_agent"].Attempts[0].Agent)
+	logData, _ = os.ReadFile(taskMap["no_agent"].Attempts[0].LogFile)
+	utils.AssertStringEqual(t, "waiting for an agent with labels: test_gpu, test_arm\n", string(logData))
+
+	// TODO: cleanup
+}
+
+func Test_Agents_ShouldRescheduleOrFailTheJobsOfAgentsThatStopSendingHeartbeats(t *testing.T) {
+	// arrange
+	Agents.serve(testLogger)
+	Agents.mutex.Lock()
+	var heartbeatInterval = Agents.heartbeatInterval
+	Agents.heartbeatInterval = 50 * time.Millisecond
+	Agents.mutex.Unlock()
+	t.Cleanup(func() {
+		Agents.mutex.Lock()
+		Agents.heartbeatInterval = heartbeatInterval
+		Agents.mutex.Unlock()
+	})
+
+	process, err := agentExecutor{pipelineName: "test"}.start(data.Stage{Name: "encode", Task: "encode", RunsOn: []string{"test_flaky"}}, nil)
+	utils.AssertTrue(t, err == nil)
+	var output = make(chan string)
+	go func() {
+		outputData, _ := io.ReadAll(process.stdout())
+		output <- string(outputData)
+	}()
+
+	var first = Agents.register(data.AgentRegistration{Name: "first", Labels: []string{"test_flaky"}})
+	var firstJob, _ = Agents.poll(context.Background(), first.Id)
+
+	// the second agent keeps sending heartbeats until it's done
+	var second = Agents.register(data.AgentRegistration{Name: "second", Labels: []string{"test_flaky", "linux"}})
+	var secondLost = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-secondLost:
+				return
+			case <-time.After(10 * time.Millisecond):
+				Agents.heartbeat(second.Id)
+			}
+		}
+	}()
+
+	// act
+	// the first agent is lost before starting the job, so it's given to the second one
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var secondJob, _ = Agents.poll(ctx, second.Id)
+	utils.AssertTrue(t, secondJob != nil)
+	utils.AssertTrue(t, Agents.start(second.Id, secondJob.Id))
+	utils.AssertTrue(t, Agents.writeOutput(second.Id, secondJob.Id, []byte("encoding\n")))
+
+	// the second agent is lost while it's running the job, so it fails
+	close(secondLost)
+	var exit = process.wait()
+
+	// assert
+	utils.AssertStringEqual(t, firstJob.Id, secondJob.Id)
+	_, firstRegistered := Agents.heartbeat(first.Id)
+	utils.AssertFalse(t, firstRegistered)
+
+	utils.AssertStringEqual(t, data.FailureReason["AGENT_LOST"], exit.failureReason)
+	utils.AssertStringEqual(t, "second", exit.agent)
+	utils.AssertEqual(t, -1, exit.exitCode)
+	utils.AssertStringEqual(t, "agent 'second' stopped sending heartbeats", exit.err.Error())
+	utils.AssertStringEqual(t, "waiting for an agent with labels: test_flaky\nencoding\n", <-output)
+}
+
+func Test_Agents_ShouldRequeueTheJobsAgentsDontStartInTime(t *testing.T) {
+	// arrange
+	Agents.serve(testLogger)
+	Agents.mutex.Lock()
+	var heartbeatInterval = Agents.heartbeatInterval
+	Agents.heartbeatInterval = 50 * time.Millisecond
+	Agents.mutex.Unlock()
+	t.Cleanup(func() {
+		Agents.mutex.Lock()
+		Agents.heartbeatInterval = heartbeatInterval
+		Agents.mutex.Unlock()
+	})
+
+	process, err := agentExecutor{pipelineName: "test"}.start(data.Stage{Name: "render", Task: "render", RunsOn: []string{"test_unreliable"}}, nil)
+	utils.AssertTrue(t, err == nil)
+	go io.Copy(io.Discard, process.stdout())
+
+	// both agents keep sending heartbeats, but the first one never got the response giving it the job
+	var first = Agents.register(data.AgentRegistration{Name: "first", Labels: []string{"test_unreliable"}})
+	var second = Agents.register(data.AgentRegistration{Name: "second", Labels: []string{"test_unreliable"}})
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				Agents.heartbeat(first.Id)
+				Agents.heartbeat(second.Id)
+			}
+		}
+	}()
+	var firstJob, _ = Agents.poll(context.Background(), first.Id)
+
+	// act
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var secondJob, _ = Agents.poll(ctx, second.Id)
+	utils.AssertTrue(t, secondJob != nil)
+	var secondStarted = Agents.start(second.Id, secondJob.Id)
+	var firstStarted = Agents.start(first.Id, firstJob.Id)
+	Agents.exited(second.Id, secondJob.Id, data.AgentJobExit{})
+	var exit = process.wait()
+
+	// assert
+	utils.AssertStringEqual(t, firstJob.Id, secondJob.Id)
+	utils.AssertTrue(t, secondStarted)
+	utils.AssertFalse(t, firstStarted)
+	utils.AssertStringEqual(t, "second", exit.agent)
+	utils.AssertEqual(t, 0, exit.exitCode)
+}
+
+func Test_Agents_ShouldNotGiveJobsToAgentsThatStoppedPolling(t *testing.T) {
+	// arrange
+	Agents.serve(testLogger)
+	process, err := agentExecutor{pipelineName: "test"}.start(data.Stage{Name: "upload", Task: "upload", RunsOn: []string{"test_gone"}}, nil)
+	utils.AssertTrue(t, err == nil)
+	go io.Copy(io.Discard, process.stdout())
+	var gone = Agents.register(data.AgentRegistration{Name: "gone", Labels: []string{"test_gone"}})
+	var polling = Agents.register(data.AgentRegistration{Name: "polling", Labels: []string{"test_gone"}})
+
+	// act
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var goneJob, goneRegistered = Agents.poll(ctx, gone.Id)
+	var pollingJob, _ = Agents.poll(context.Background(), polling.Id)
+	process.kill()
+
+	// assert
+	utils.AssertTrue(t, goneRegistered)
+	utils.AssertTrue(t, goneJob == nil)
+	utils.AssertTrue(t, pollingJob != nil)
+}
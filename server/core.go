@@ -2,48 +2,60 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"pipeline/data"
 	"pipeline/utils"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func runTask(stage data.Stage, pipelineName string) (bool, string) {
-	cmd := exec.Command(stage.Task, stage.Args...)
-	cmd.Dir = stage.Pwd
-	cmd.Env = stage.Env
+// how long a timed out task gets to stop after being asked to, before it is killed
+const TERMINATE_GRACE_PERIOD = 10 * time.Second
 
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return false, err.Error()
-	}
+// a line a task prints to stdout to publish an output, e.g. "::set-output new_count=3"
+const OUTPUT_MARKER = "::set-output "
 
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return false, err.Error()
-	}
+// runTask runs the stage's task (or each of its steps in order) with its executor to completion, or until timeout
+// (if greater than 0) expires or ctx is cancelled. Returns the record of this attempt at running the task, including
+// why it failed if it wasn't successful. With steps, the attempt fails at the first step that fails and the rest
+// don't run. The stage's limits (if any) are applied to the process of each step, see stageLimits.
+func runTask(ctx context.Context, stage data.Stage, pipelineName string, attempt int, timeout time.Duration) (result data.TaskAttempt) {
+	result = data.TaskAttempt{Attempt: attempt, ExitCode: -1, StartedAt: time.Now()}
+	defer func() { result.EndedAt = time.Now() }()
 
-	err = cmd.Start()
-	if err != nil {
-		return false, err.Error()
+	// anything that goes wrong before the task is running counts as failing to spawn it
+	spawnError := func(err error) data.TaskAttempt {
+		result.FailureReason = data.FailureReason["SPAWN_ERROR"]
+		result.Error = err.Error()
+		return result
 	}
 
-	if pipelineName == "" {
-		pipelineName = "pipeline"
+	if ctx.Err() != nil {
+		result.Cancelled = true
+		result.FailureReason = data.FailureReason["CANCELLED"]
+		result.Error = "cancelled before starting"
+		return result
 	}
 
-	var outputLogName = utils.CreateOutputLogName(pipelineName, stage.Name, false)
-	logFile, err := os.OpenFile(outputLogName, os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := openAttemptLog(pipelineName, stage.Name, attempt)
 	if err != nil {
-		return false, err.Error()
+		return spawnError(err)
 	}
 	defer logFile.Close()
+	result.LogFile = logFile.Name()
 
 	// Do we really want a separate file for the error logs?
 	// var errorLogName = utils.CreateOutputLogName(pipelineName, stage.Name, true)
@@ -53,16 +65,330 @@ func runTask(stage data.Stage, pipelineName string) (bool, string) {
 	// }
 	// defer errorLogFile.Close()
 
+	// the task can publish outputs by writing key=value lines to the file named in PIPELINE_OUTPUT
+	outputFile, err := os.CreateTemp("", "pipeline-output-*")
+	if err != nil {
+		return spawnError(err)
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	// entries in the file win over the stdout markers, they are read once the task is done writing
+	var outputs = make(map[string]string)
+	defer func() {
+		if outputFileData, err := os.ReadFile(outputFile.Name()); err == nil {
+			for _, line := range strings.Split(string(outputFileData), "\n") {
+				parseOutput(line, outputs)
+			}
+		}
+		if len(outputs) > 0 {
+			result.Outputs = outputs
+		}
+	}()
+
+	// a stage without steps runs its task like a single step, that isn't recorded separately
+	var steps = stage.Steps
+	if len(steps) == 0 {
+		steps = []data.Step{{Task: stage.Task, Args: stage.Args}}
+	}
+
+	// the limits are applied to each step's process, and what they use recorded along with them
+	var limits *stageLimits
+	if stage.Limits != nil {
+		limits = newStageLimits(*stage.Limits)
+		defer func() {
+			limits.close()
+			result.Limits = limits.usage
+		}()
+	}
+	var taskExecutor = newExecutor(stage.ExecutorConfig, pipelineName, limits)
+
+	// the timeout is for the whole attempt, each step gets whatever is left of it
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = result.StartedAt.Add(timeout)
+	}
+
+	for i, step := range steps {
+		var stepResult = data.StepResult{Name: step.Name, ExitCode: -1, StartedAt: time.Now()}
+		var stepLabel = ""
+		if len(stage.Steps) > 0 {
+			if stepResult.Name == "" {
+				stepResult.Name = "step " + strconv.Itoa(i+1)
+			}
+			stepLabel = "step '" + stepResult.Name + "': "
+			logFile.WriteString("==> " + stepResult.Name + "\n")
+		}
+		recordStep := func() {
+			if len(stage.Steps) > 0 {
+				stepResult.EndedAt = time.Now()
+				result.Steps = append(result.Steps, stepResult)
+			}
+		}
+		fail := func(reason string, message string) data.TaskAttempt {
+			result.FailureReason = reason
+			result.Error = stepLabel + message
+			stepResult.Error = result.Error
+			recordStep()
+			return result
+		}
+		result.ExitCode, result.Signal = -1, ""
+
+		// the run could have been cancelled, or run out of time, while the step before was running
+		var stepTimeout time.Duration
+		if !deadline.IsZero() {
+			stepTimeout = time.Until(deadline)
+		}
+		if ctx.Err() != nil {
+			result.Cancelled = true
+			return fail(data.FailureReason["CANCELLED"], "cancelled before starting")
+		}
+		if !deadline.IsZero() && stepTimeout <= 0 {
+			result.TimedOut = true
+			return fail(data.FailureReason["TIMEOUT"], "timed out after "+timeout.String())
+		}
+
+		var stepStage = stage
+		stepStage.Task, stepStage.Args = step.Task, step.Args
+		// the step's env entries go on top of the stage's, the process gets the last entry of a name
+		var env = append(append(slices.Clone(stage.Env), step.Env...), "PIPELINE_OUTPUT="+outputFile.Name())
+		process, err := taskExecutor.start(stepStage, env)
+		if err != nil {
+			return fail(data.FailureReason["SPAWN_ERROR"], err.Error())
+		}
+
+		timedOut, cancelled, exit := waitCommand(ctx, process, logFile, stepTimeout, outputs)
+		result.ExitCode = exit.exitCode
+		result.Signal = exit.signal
+		if exit.agent != "" {
+			result.Agent = exit.agent
+		}
+		stepResult.ExitCode, stepResult.Signal = result.ExitCode, result.Signal
+		if exit.usage != nil {
+			stepResult.Usage = exit.usage
+			result.Usage = addUsage(result.Usage, *exit.usage)
+			if limits != nil {
+				limits.record(*exit.usage)
+			}
+		}
+		if cancelled {
+			result.Cancelled = true
+			return fail(data.FailureReason["CANCELLED"], "cancelled")
+		}
+		if timedOut {
+			result.TimedOut = true
+			return fail(data.FailureReason["TIMEOUT"], "timed out after "+timeout.String())
+		}
+		if exit.err != nil {
+			if limits != nil && exit.usage != nil {
+				if message := limits.exceeded(*exit.usage, result.Signal); message != "" {
+					return fail(data.FailureReason["LIMIT_EXCEEDED"], message)
+				}
+			}
+			if exit.failureReason != "" {
+				return fail(exit.failureReason, exit.err.Error())
+			}
+			return fail(data.FailureReason["NON_ZERO_EXIT"], exit.err.Error())
+		}
+		recordStep()
+	}
+
+	result.Successful = true
+	return result
+}
+
+// addUsage adds what another process (or step, or attempt) used to total, which is nil if nothing was added to it yet
+func addUsage(total *data.ResourceUsage, usage data.ResourceUsage) *data.ResourceUsage {
+	if total == nil {
+		return &usage
+	}
+
+	total.UserCpuMs += usage.UserCpuMs
+	total.SystemCpuMs += usage.SystemCpuMs
+	total.MaxRssKB = max(total.MaxRssKB, usage.MaxRssKB)
+	total.BlockReads += usage.BlockReads
+	total.BlockWrites += usage.BlockWrites
+	total.VoluntaryContextSwitches += usage.VoluntaryContextSwitches
+	total.InvoluntaryContextSwitches += usage.InvoluntaryContextSwitches
+	return total
+}
+
+// openAttemptLog creates the log file of an attempt at running a stage
+func openAttemptLog(pipelineName string, stageName string, attempt int) (*os.File, error) {
+	if pipelineName == "" {
+		pipelineName = "pipeline"
+	}
+
+	// retries get their own log file, otherwise attempts within the same second would write over each other
+	var logName = stageName
+	if attempt > 1 {
+		logName += " attempt " + strconv.Itoa(attempt)
+	}
+
+	// runs of the same pipeline started at the same time (e.g. by pipeline stages) would share a log file
+	for n := 1; ; n++ {
+		var name = logName
+		if n > 1 {
+			name += " (" + strconv.Itoa(n) + ")"
+		}
+		logFile, err := os.OpenFile(utils.CreateOutputLogName(pipelineName, name, false), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !os.IsExist(err) {
+			return logFile, err
+		}
+	}
+}
+
+// the pipelines that started the current run through pipeline stages, outermost first, kept in the run's context
+type pipelineChainKey struct{}
+
+func pipelineChain(ctx context.Context) []string {
+	chain, _ := ctx.Value(pipelineChainKey{}).([]string)
+	return chain
+}
+
+// runSubPipeline runs the registered pipeline a pipeline stage points to, as a run of its own that is linked to
+// parentRun, and waits for it to finish or for timeout (if greater than 0) to expire or ctx to be cancelled. The
+// attempt succeeds if that run does. A pipeline can't be run again by a pipeline it (indirectly) started.
+func runSubPipeline(ctx context.Context, stage data.Stage, parentRun *data.PipelineRun, attempt int, timeout time.Duration,
+	logger *logrus.Logger) (result data.TaskAttempt) {
+	result = data.TaskAttempt{Attempt: attempt, ExitCode: -1, StartedAt: time.Now()}
+	defer func() { result.EndedAt = time.Now() }()
+
+	fail := func(reason string, message string) data.TaskAttempt {
+		result.FailureReason = reason
+		result.Error = message
+		return result
+	}
+
+	if ctx.Err() != nil {
+		result.Cancelled = true
+		return fail(data.FailureReason["CANCELLED"], "cancelled before starting")
+	}
+
+	var chain = append(slices.Clone(pipelineChain(ctx)), parentRun.Name)
+	if slices.Contains(chain, stage.Pipeline) {
+		return fail(data.FailureReason["PIPELINE_ERROR"],
+			"can't run pipeline '"+stage.Pipeline+"' recursively: "+strings.Join(append(chain, stage.Pipeline), " -> "))
+	}
+
+	pipeline, message, _ := loadPipeline(stage.Pipeline, stage.Variables, logger)
+	if pipeline == nil {
+		return fail(data.FailureReason["PIPELINE_ERROR"], message)
+	}
+
+	logFile, err := openAttemptLog(parentRun.Name, stage.Name, attempt)
+	if err != nil {
+		return fail(data.FailureReason["SPAWN_ERROR"], err.Error())
+	}
+	defer logFile.Close()
+	result.LogFile = logFile.Name()
+
+	var parentStage = data.RunLink{Pipeline: parentRun.Name, Id: parentRun.Id, Stage: stage.Name}
+	var childCtx, cancel = context.WithCancel(withAncestorStage(context.WithValue(ctx, pipelineChainKey{}, chain), parentStage))
+	defer cancel()
+	if timeout > 0 {
+		childCtx, cancel = context.WithTimeout(childCtx, timeout)
+		defer cancel()
+	}
+
+	// in server mode the run is the pipeline's active run, so it shows as running and can be cancelled on its own
+	var childRun = &data.PipelineRun{Id: utils.GenerateId(), Name: stage.Pipeline, StartedAt: time.Now(), Status: data.RunStatus["QUEUED"],
+		ParentRun: &parentStage}
+	runsMutex.Lock()
+	var item, registered = Pipelines[stage.Pipeline]
+	if registered && item.Status == data.PipelineStatus["RUNNING"] {
+		runsMutex.Unlock()
+		return fail(data.FailureReason["PIPELINE_ERROR"], "pipeline '"+stage.Pipeline+"' is already running")
+	}
+	if registered {
+		startActiveRun(stage.Pipeline, childRun, cancel)
+	}
+	runsMutex.Unlock()
+
+	result.ChildRun = &data.RunLink{Pipeline: stage.Pipeline, Id: childRun.Id}
+	logFile.WriteString("Running pipeline " + stage.Pipeline + ", run " + childRun.Id + "\n")
+	successful, finishedRun := runPipeline(childCtx, pipeline, childRun, logger)
+	logFile.WriteString("Pipeline " + stage.Pipeline + " run " + childRun.Id + " finished with status: " + finishedRun.Status + "\n")
+	if registered {
+		finishActiveRun(stage.Pipeline, successful, finishedRun, logger)
+	}
+
+	if successful {
+		result.ExitCode = 0
+		result.Successful = true
+		return result
+	}
+
+	// a timeout of the stage cancels the run, that is told apart from the stage (or the run itself) being cancelled
+	if timeout > 0 && errors.Is(childCtx.Err(), context.DeadlineExceeded) {
+		result.TimedOut = true
+		return fail(data.FailureReason["TIMEOUT"], "timed out after "+timeout.String())
+	}
+	if finishedRun.Status == data.RunStatus["CANCELLED"] {
+		result.Cancelled = ctx.Err() != nil
+		return fail(data.FailureReason["CANCELLED"], "pipeline '"+stage.Pipeline+"' run was cancelled")
+	}
+
+	// the first stage that didn't succeed says why, like the first instance of a matrix stage
+	for _, response := range finishedRun.Stages {
+		if !data.StageStatusSuccessful(response.Status) {
+			result.ExitCode = response.ExitCode
+			result.TimedOut = finishedRun.Status == data.RunStatus["TIMED_OUT"]
+			return fail(data.FailureReason["PIPELINE_FAILED"],
+				"pipeline '"+stage.Pipeline+"' failed at stage '"+response.TaskName+"': "+response.Error)
+		}
+	}
+	return fail(data.FailureReason["PIPELINE_FAILED"], "pipeline '"+stage.Pipeline+"' failed")
+}
+
+// waitCommand waits for a started command to exit, or for timeout (if greater than 0) to expire or ctx to be cancelled.
+// Its output is written to logFile, and any outputs it prints to stdout are added to outputs.
+// Returns if it was stopped because it timed out or was cancelled, and how it exited.
+func waitCommand(ctx context.Context, process process, logFile *os.File, timeout time.Duration, outputs map[string]string) (bool, bool, processExit) {
+	// stop the command and anything it started when the timeout expires or the run is cancelled,
+	// first nicely then forcefully after the grace period
+	var timedOut, cancelled atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var timeoutChan <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			cancelled.Store(true)
+		case <-timeoutChan:
+			timedOut.Store(true)
+		}
+
+		process.terminate()
+
+		select {
+		case <-done:
+		case <-time.After(TERMINATE_GRACE_PERIOD):
+			process.kill()
+		}
+	}()
+
 	logReaderWg := sync.WaitGroup{}
 	logReaderWg.Add(2)
 
 	go func() {
 		defer logReaderWg.Done()
 
-		scanner := bufio.NewScanner(stdoutPipe)
+		scanner := bufio.NewScanner(process.stdout())
 		for scanner.Scan() {
 			line := scanner.Text()
 			logFile.WriteString(line + "\n")
+			if strings.HasPrefix(line, OUTPUT_MARKER) {
+				parseOutput(strings.TrimPrefix(line, OUTPUT_MARKER), outputs)
+			}
 		}
 
 		// if err := scanner.Err(); err != nil {
@@ -73,7 +399,7 @@ func runTask(stage data.Stage, pipelineName string) (bool, string) {
 	go func() {
 		defer logReaderWg.Done()
 
-		scanner := bufio.NewScanner(stderrPipe)
+		scanner := bufio.NewScanner(process.stderr())
 		for scanner.Scan() {
 			line := scanner.Text()
 			logFile.WriteString(line + "\n")
@@ -85,175 +411,673 @@ func runTask(stage data.Stage, pipelineName string) (bool, string) {
 	}()
 
 	logReaderWg.Wait()
-	err = cmd.Wait()
-	if err != nil {
-		return false, err.Error()
+	exit := process.wait()
+	return timedOut.Load(), cancelled.Load(), exit
+}
+
+// parseOutput adds a key=value line published by a task to its outputs, lines that aren't in that format are ignored.
+// Keys are limited to the characters allowed in {stages.NAME.KEY}.
+func parseOutput(line string, outputs map[string]string) {
+	key, value, found := strings.Cut(strings.TrimRight(line, "\r"), "=")
+	key = strings.TrimSpace(key)
+	if !found || !utils.NameRegex.MatchString(key) {
+		return
+	}
+	outputs[key] = value
+}
+
+// buildCommand creates the command for a stage's task. With a shell the task string is run through it, so pipes,
+// redirects, && and globbing work, and the args are appended quoted. Otherwise the task is run directly as an executable.
+func buildCommand(stage data.Stage) *exec.Cmd {
+	if stage.Shell == "" || stage.Shell == "none" {
+		return exec.Command(stage.Task, stage.Args...)
 	}
 
-	return true, ""
+	var script = stage.Task
+	for _, arg := range stage.Args {
+		script += " " + utils.ShellQuote(stage.Shell, arg)
+	}
+	var cmd = exec.Command(stage.Shell, utils.ShellFlag(stage.Shell), script)
+	if utils.IsCmd(stage.Shell) {
+		setCmdCommandLine(cmd, script)
+	}
+	return cmd
 }
 
-// for api server this will need to run on a separate thread?
-// these logs are useful in headless mode, but in server mode they will probably be a log of noise.
-// consider disabling them when running in server mode?
-func runPipeline(pipeline *data.Pipeline, pipelineRun *data.PipelineRun, logger *logrus.Logger) (bool, data.PipelineRun) {
+// resolveThreads works out how many stages of the pipeline can run at once. Serial pipelines get 1, parallel
+// ones get max_parallel if set, otherwise half of the CPUs. Either way it is capped by the MAX_PARALLEL env var (if set).
+func resolveThreads(pipeline *data.Pipeline, logger *logrus.Logger) int {
 	var threads = 1
 	if pipeline.Parallel {
-		threads = runtime.NumCPU() / 2 // should this be configurable?
+		if pipeline.MaxParallel > 0 {
+			threads = pipeline.MaxParallel
+		} else {
+			threads = runtime.NumCPU() / 2
+		}
+	}
+
+	if os.Getenv("MAX_PARALLEL") != "" {
+		maxParallel, err := strconv.Atoi(os.Getenv("MAX_PARALLEL"))
+		if err != nil || maxParallel < 1 {
+			logger.Warn("Ignoring invalid MAX_PARALLEL environment variable: " + os.Getenv("MAX_PARALLEL"))
+		} else if threads > maxParallel {
+			threads = maxParallel
+		}
 	}
-	logger.Debug("Running pipeline " + pipeline.Name + " with " + fmt.Sprint(threads) + " thread(s)")
+
+	if threads < 1 {
+		threads = 1 // a single core machine would otherwise never start a task
+	}
+	return threads
+}
+
+// stageTimeout returns how long an attempt at running a stage's task can take, which is the stage's own
+// timeout capped to what is left before the run's deadline (if there is one). 0 means there is no limit.
+func stageTimeout(stage data.Stage, deadline time.Time) time.Duration {
+	timeout, _ := utils.ParseDuration(stage.Timeout) // already validated
+	if !deadline.IsZero() {
+		var remaining = time.Until(deadline)
+		if remaining <= 0 {
+			remaining = time.Nanosecond // the deadline has passed, so stop straight away
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// retryDelay works out if a failed attempt at running a stage's task should be retried based on the stage's
+// retry policy, and if so how long to wait before the next attempt.
+func retryDelay(retry *data.RetryPolicy, attempt data.TaskAttempt, deadline time.Time) (time.Duration, bool) {
+	if retry == nil || attempt.Attempt >= retry.MaxAttempts || attempt.Cancelled {
+		return 0, false
+	}
+
+	if len(retry.ExitCodes) > 0 && !slices.Contains(retry.ExitCodes, attempt.ExitCode) {
+		return 0, false
+	}
+
+	// durations are already validated
+	delay, _ := utils.ParseDuration(retry.Delay)
+	maxDelay, _ := utils.ParseDuration(retry.MaxDelay)
+	if retry.Backoff == "exponential" {
+		for i := 1; i < attempt.Attempt && (maxDelay == 0 || delay < maxDelay) && delay < math.MaxInt64/2; i++ {
+			delay *= 2
+		}
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if retry.Jitter && delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	// no point in trying again if the run will time out before the next attempt starts
+	if !deadline.IsZero() && !time.Now().Add(delay).Before(deadline) {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// stageOutputs collects the outputs published by the stages that have finished, by stage name
+func stageOutputs(taskResponses map[string]data.TaskStatusResponse) map[string]map[string]string {
+	var outputs = make(map[string]map[string]string, len(taskResponses))
+	for name, response := range taskResponses {
+		if response.Outputs != nil {
+			outputs[name] = response.Outputs
+		}
+	}
+	return outputs
+}
+
+// checkDependencies reports whether every dependency of a stage has finished, and if so whether
+// any of them failed or was skipped. A failed dependency takes precedence over a skipped one.
+func checkDependencies(stage data.Stage, taskResponses map[string]data.TaskStatusResponse) (bool, bool, bool) {
+	var failed, skipped = false, false
+	for _, dependency := range stage.DependsOn {
+		response, done := taskResponses[dependency]
+		if !done {
+			return false, false, false
+		}
+
+		if !data.StageStatusSuccessful(response.Status) {
+			failed = true
+		} else if response.Status == data.StageStatus["SKIPPED"] {
+			skipped = true
+		}
+	}
+
+	return true, failed, skipped
+}
+
+// stageWait keeps track of how long a stage that was ready to run has waited for locks, and for resources
+type stageWait struct {
+	reason    string // "locks" or "resources", what it's waiting for now
+	since     time.Time
+	locks     time.Duration
+	resources time.Duration
+}
+
+func (w *stageWait) waitFor(reason string) {
+	if w.reason == reason {
+		return
+	}
+	w.stop()
+	w.reason, w.since = reason, time.Now()
+}
+
+func (w *stageWait) stop() {
+	switch w.reason {
+	case "locks":
+		w.locks += time.Since(w.since)
+	case "resources":
+		w.resources += time.Since(w.since)
+	}
+	w.reason = ""
+}
+
+// cleanup stages run even when their dependencies fail or the run is cancelled
+func isCleanupStage(stage data.Stage) bool {
+	return stage.RunOn == "failure" || stage.RunOn == "always"
+}
+
+// transitionStage moves a stage to its next status, refusing moves that aren't allowed (e.g. changing a finished stage)
+func transitionStage(response *data.TaskStatusResponse, status string, logger *logrus.Logger) bool {
+	if !data.CanTransitionStage(response.Status, status) {
+		logger.Error("Invalid status change for stage " + response.TaskName + ": " + response.Status + " -> " + status)
+		return false
+	}
+
+	response.Status = status
+	return true
+}
+
+// transitionRun moves a run to its next status, refusing moves that aren't allowed (e.g. changing a finished run)
+func transitionRun(pipelineRun *data.PipelineRun, status string, logger *logrus.Logger) bool {
+	if !data.CanTransitionRun(pipelineRun.Status, status) {
+		logger.Error("Invalid status change for run " + pipelineRun.Id + ": " + pipelineRun.Status + " -> " + status)
+		return false
+	}
+
+	pipelineRun.Status = status
+	return true
+}
+
+// attemptStatus is the status a stage ends up with when the given attempt is its last
+func attemptStatus(stage data.Stage, attempt data.TaskAttempt) string {
+	if attempt.Successful {
+		return data.StageStatus["SUCCEEDED"]
+	}
+	if attempt.Cancelled {
+		return data.StageStatus["CANCELLED"]
+	}
+	if stage.AllowFailure {
+		return data.StageStatus["FAILED_ALLOWED"]
+	}
+	if attempt.TimedOut {
+		return data.StageStatus["TIMED_OUT"]
+	}
+	return data.StageStatus["FAILED"]
+}
+
+// matrixResponse sums up the instances of a matrix stage for the stages that depend on it. It failed (or was cancelled
+// etc.) if any of its instances did, taking on the first one's status, and was skipped if they all were.
+func matrixResponse(name string, instances []data.TaskStatusResponse) data.TaskStatusResponse {
+	var response = data.TaskStatusResponse{TaskName: name, Status: data.StageStatus["SKIPPED"]}
+	for _, instance := range instances {
+		if !data.StageStatusSuccessful(instance.Status) {
+			response.Status = instance.Status
+			response.ExitCode = instance.ExitCode
+			response.FailureReason = instance.FailureReason
+			response.Error = instance.TaskName + ": " + instance.Error
+			return response
+		}
+		if instance.Status != data.StageStatus["SKIPPED"] {
+			response.Status = data.StageStatus["SUCCEEDED"]
+		}
+	}
+	return response
+}
+
+// these logs are useful in headless mode, but in server mode they will probably be a log of noise.
+// consider disabling them when running in server mode?
+// Cancelling ctx stops the running stages and marks the ones that haven't started yet as cancelled.
+func runPipeline(ctx context.Context, pipeline *data.Pipeline, pipelineRun *data.PipelineRun, logger *logrus.Logger) (bool, data.PipelineRun) {
+	var threads = resolveThreads(pipeline, logger)
+	logger.Info("Running pipeline " + pipeline.Name + " with " + fmt.Sprint(threads) + " thread(s)")
 
 	if pipelineRun == nil {
-		pipelineRun = &data.PipelineRun{
-			Name:       pipeline.Name,
-			StartedAt:  time.Now(),
-			Successful: true,
-			Stages:     make([]data.TaskStatusResponse, 0, len(pipeline.Stages)),
+		pipelineRun = &data.PipelineRun{Id: utils.GenerateId(), Status: data.RunStatus["QUEUED"]}
+	} else if pipelineRun.Id == "" {
+		pipelineRun.Id = utils.GenerateId()
+	}
+	if pipelineRun.Status == "" {
+		pipelineRun.Status = data.RunStatus["QUEUED"]
+	}
+	pipelineRun.Name = pipeline.Name
+	pipelineRun.StartedAt = time.Now()
+	pipelineRun.MaxParallel = threads
+	pipelineRun.Warnings = 0
+	transitionRun(pipelineRun, data.RunStatus["RUNNING"], logger)
+
+	// matrix stages run as an instance per combination of their values, each instance is a stage of its own from here on
+	var stages = utils.ExpandMatrix(pipeline.Stages)
+	var matrixInstances = make(map[string][]string) // matrix stage name -> the names of its instances
+	var runningInstances = make(map[string]int)     // matrix stage name -> how many of its instances are running
+	for _, stage := range stages {
+		if stage.MatrixOf != "" {
+			matrixInstances[stage.MatrixOf] = append(matrixInstances[stage.MatrixOf], stage.Name)
 		}
-	} else {
-		pipelineRun.Name = pipeline.Name
-		pipelineRun.StartedAt = time.Now()
-		pipelineRun.Successful = true
-		pipelineRun.Stages = make([]data.TaskStatusResponse, 0, len(pipeline.Stages))
+	}
+
+	// every stage is queued until it gets started or resolved
+	pipelineRun.Stages = make([]data.TaskStatusResponse, 0, len(stages))
+	for _, stage := range stages {
+		pipelineRun.Stages = append(pipelineRun.Stages, data.TaskStatusResponse{TaskName: stage.Name, Status: data.StageStatus["QUEUED"], ExitCode: -1,
+			Matrix: stage.MatrixValues})
+	}
+
+	// the run timeout is a deadline every stage's timeout gets capped to
+	var deadline time.Time
+	if runTimeout, _ := utils.ParseDuration(pipeline.Timeout); runTimeout > 0 {
+		deadline = pipelineRun.StartedAt.Add(runTimeout)
 	}
 
 	// could have replaced these with the mutex, but I liked the channel approach I originally had for collecting task responses at completion
-	taskResponses := make(map[string]data.TaskStatusResponse, len(pipeline.Stages))
-	taskStatusBuffer := make(chan data.TaskStatusResponse, threads)
+	taskResponses := make(map[string]data.TaskStatusResponse, len(stages))
+	taskStatusBuffer := make(chan data.TaskStatusResponse, len(stages))
 
-	var taskWg sync.WaitGroup
 	var activeThreads = 0
 	var pipelineMutex sync.Mutex // Mutex to protect pipelineRun updates
 
-	// Helper function to safely update pipelineRun with completed task
-	updatePipelineRun := func(taskResponse data.TaskStatusResponse) {
+	// Helper function to safely update the stage (by its index in the definition) in pipelineRun
+	updatePipelineRun := func(index int, taskResponse data.TaskStatusResponse) {
 		pipelineMutex.Lock()
 		defer pipelineMutex.Unlock()
 
-		// Find and update existing stage or append new one
-		updated := false
-		for i, stage := range pipelineRun.Stages {
-			if stage.TaskName == taskResponse.TaskName {
-				pipelineRun.Stages[i] = taskResponse
-				updated = true
-				break
-			}
+		pipelineRun.Stages[index] = taskResponse
+	}
+
+	// record a finished stage for its dependents. Once every instance of a matrix stage has finished, the matrix
+	// stage as a whole is recorded too, that's what the stages that depend on it wait for
+	finish := func(stage data.Stage, taskResponse data.TaskStatusResponse) {
+		taskResponses[taskResponse.TaskName] = taskResponse
+		if stage.MatrixOf == "" {
+			return
 		}
 
-		// not updated, must be a new entry
-		if !updated {
-			pipelineRun.Stages = append(pipelineRun.Stages, taskResponse)
+		var instances = make([]data.TaskStatusResponse, 0, len(matrixInstances[stage.MatrixOf]))
+		for _, name := range matrixInstances[stage.MatrixOf] {
+			response, done := taskResponses[name]
+			if !done {
+				return
+			}
+			instances = append(instances, response)
 		}
+		taskResponses[stage.MatrixOf] = matrixResponse(stage.MatrixOf, instances)
 	}
 
-	collect := func(reInit bool) {
-		taskWg.Wait()
-		close(taskStatusBuffer)
-		for i := range taskStatusBuffer {
-			taskResponses[i.TaskName] = i
-			updatePipelineRun(i)
-		}
-		if reInit {
-			taskStatusBuffer = make(chan data.TaskStatusResponse, threads)
-			activeThreads = 0
+	// finish a stage that never gets to run, with why it was skipped or failed. This is what unblocks its dependents
+	resolve := func(index int, status string, reason string, message string) {
+		taskResponse := data.TaskStatusResponse{TaskName: stages[index].Name, Status: data.StageStatus["QUEUED"], ExitCode: -1,
+			FailureReason: reason, Matrix: stages[index].MatrixValues}
+		if status == data.StageStatus["SKIPPED"] {
+			taskResponse.SkipReason = message
+		} else {
+			taskResponse.Error = message
 		}
+		transitionStage(&taskResponse, status, logger)
+		finish(stages[index], taskResponse)
+		updatePipelineRun(index, taskResponse)
+	}
+
+	// the indexes of the stages that haven't been started or resolved yet
+	pending := make([]int, len(stages))
+	for i := range pending {
+		pending[i] = i
 	}
 
-	for _, stage := range pipeline.Stages {
-		// making tasks wait on their dependencies. this why it is critical to define
-		// the order of tasks carefully, because this will block all subsequent tasks
-		// this is by design to keep it simple for now
-		if len(stage.DependsOn) > 0 {
-			logger.Debug("Checking dependencies for: " + stage.Name)
-			var dependenciesFailed = false
-			for _, dependency := range stage.DependsOn {
-				if _, ok := taskResponses[dependency]; !ok {
-					logger.Info("Waiting for dependency: '" + dependency + "' for stage: " + stage.Name)
-					collect(true) // wait for dependency to finish
-					logger.Info("Dependency finished: '" + dependency + "' for stage: " + stage.Name)
+	// the resources the running stages of this run need, and the capacity every run shares
+	var resourcesInUse = make(map[string]int)
+	var serverCapacity = utils.ServerCapacity(logger)
+
+	// how long the stages that were ready to run have waited for locks or resources (held by this run or another one)
+	var waits = make(map[int]*stageWait)
+
+	for len(pending) > 0 || activeThreads > 0 {
+		// set when a stage couldn't get its locks or the server's resources, it is closed as soon as any are released
+		var sharedReleased <-chan struct{}
+
+		// keep sweeping the pending stages until nothing else can be started or resolved, a stage that
+		// gets skipped can unblock stages before it in the list, so a single pass is not enough
+		var progressed = true
+		for progressed {
+			progressed = false
+			var waiting = make([]int, 0, len(pending))
+
+			for _, index := range pending {
+				var stage = stages[index]
+				var cleanup = isCleanupStage(stage)
+
+				// nothing new gets started once the run is cancelled, except for cleanup stages
+				if ctx.Err() != nil && !cleanup {
+					logger.Warn("Run cancelled before stage: " + stage.Name + " could start")
+					resolve(index, data.StageStatus["CANCELLED"], data.FailureReason["CANCELLED"], "run cancelled before the stage started")
+					progressed = true
+					continue
 				}
 
-				if !taskResponses[dependency].Successful {
-					logger.Warn("Dependency failed: '" + dependency + "' for stage: " + stage.Name + " skipping this stage")
-					// skip this stage as the dependency failed, also mark this stage as failed
-					taskResponses[stage.Name] = data.TaskStatusResponse{TaskName: stage.Name, Successful: false, Skipped: true}
-					dependenciesFailed = true
-					break
+				ready, dependenciesFailed, dependenciesSkipped := checkDependencies(stage, taskResponses)
+				if !ready {
+					waiting = append(waiting, index)
+					continue
 				}
 
-				if taskResponses[dependency].Successful && taskResponses[dependency].Skipped {
-					// skip this stage as the dependency was skipped ... don't run tasks that have dependencies that were skipped
-					logger.Warn("Dependency skipped: '" + dependency + "' for stage: " + stage.Name + " skipping this stage")
-					taskResponses[stage.Name] = data.TaskStatusResponse{TaskName: stage.Name, Successful: true, Skipped: true}
-					break
+				// stages that handle failures only run when something they depend on didn't succeed
+				if stage.RunOn == "failure" && !dependenciesFailed {
+					logger.Info("Skipping " + stage.Name + ", none of its dependencies failed")
+					resolve(index, data.StageStatus["SKIPPED"], "", "run_on failure, none of its dependencies failed")
+					progressed = true
+					continue
 				}
-			}
 
-			if dependenciesFailed {
-				skippedTask := data.TaskStatusResponse{TaskName: stage.Name, Successful: false, Skipped: true}
-				updatePipelineRun(skippedTask)
-				continue
-			}
+				if dependenciesFailed && !cleanup {
+					// skip this stage as a dependency failed, this counts as a failure too
+					logger.Warn("Dependency failed for stage: " + stage.Name + " skipping this stage")
+					resolve(index, data.StageStatus["UPSTREAM_FAILED"], data.FailureReason["DEPENDENCY_FAILED"], "a dependency of the stage failed")
+					progressed = true
+					continue
+				}
 
-			// if skipped because dependency skipped (response marked as skipped and dependencies haven't failed ^)
-			if taskResponses[stage.Name].Skipped {
-				skippedTask := data.TaskStatusResponse{TaskName: stage.Name, Successful: true, Skipped: true}
-				updatePipelineRun(skippedTask)
-				continue
-			}
-		}
+				if dependenciesSkipped && !cleanup {
+					// skip this stage as a dependency was skipped ... don't run tasks that have dependencies that were skipped
+					logger.Warn("Dependency skipped for stage: " + stage.Name + " skipping this stage")
+					resolve(index, data.StageStatus["SKIPPED"], "", "a dependency was skipped")
+					progressed = true
+					continue
+				}
 
-		// if should skip this stage, break now and signal  ... if skipped by config mark as successful
-		if stage.Skip {
-			logger.Info("Skipping " + stage.Name + " based on config")
-			taskResponses[stage.Name] = data.TaskStatusResponse{TaskName: stage.Name, Successful: true, Skipped: true}
-			updatePipelineRun(taskResponses[stage.Name])
-			continue
-		}
+				// if should skip this stage, break now and signal  ... skipped by config doesn't count as a failure
+				if stage.Skip {
+					logger.Info("Skipping " + stage.Name + " based on config")
+					resolve(index, data.StageStatus["SKIPPED"], "", "skipped by config")
+					progressed = true
+					continue
+				}
+
+				if !deadline.IsZero() && !time.Now().Before(deadline) && !cleanup {
+					logger.Warn("Pipeline timed out before stage: " + stage.Name + " could start, skipping this stage")
+					resolve(index, data.StageStatus["TIMED_OUT"], data.FailureReason["TIMEOUT"], "pipeline timed out before the stage started")
+					progressed = true
+					continue
+				}
+
+				// the outputs of its dependencies are known now, so they can be injected along with the variables
+				var variableErrors []string
+				stage, variableErrors = utils.InjectStageVariables(stage, pipeline, stageOutputs(taskResponses))
+				if len(variableErrors) > 0 {
+					logger.Error("Unable to inject variables for stage: " + stage.Name + ": " + strings.Join(variableErrors, ", "))
+					resolve(index, data.StageStatus["FAILED"], data.FailureReason["VARIABLE_ERROR"], strings.Join(variableErrors, ", "))
+					progressed = true
+					continue
+				}
+
+				// everything the condition can check is known now, so it won't change while waiting for a thread
+				stage.Env = utils.ResolveEnv(stage, pipeline)
+				if stage.When != "" {
+					run, err := utils.EvaluateWhen(stage.When, stage.DependsOn, taskResponses, stage.Env)
+					if err != nil {
+						logger.Error("Unable to evaluate when condition for stage: " + stage.Name + ": " + err.Error())
+						resolve(index, data.StageStatus["FAILED"], data.FailureReason["CONDITION_ERROR"], "invalid when condition: "+err.Error())
+						progressed = true
+						continue
+					}
+					if !run {
+						logger.Info("Skipping " + stage.Name + ", condition not met: " + stage.When)
+						resolve(index, data.StageStatus["SKIPPED"], "", "condition not met: "+stage.When)
+						progressed = true
+						continue
+					}
+				}
+
+				// all dependencies are done, but wait for a free thread (and for the matrix stage's limit) before starting it
+				if activeThreads >= threads || (stage.MatrixOf != "" && stage.MaxParallel > 0 && runningInstances[stage.MatrixOf] >= stage.MaxParallel) {
+					waiting = append(waiting, index)
+					continue
+				}
+
+				// the stages running in this run can't need more than the pipeline's capacity
+				if waits[index] == nil {
+					waits[index] = &stageWait{}
+				}
+				if !utils.FitsCapacity(stage.Resources, resourcesInUse, pipeline.Capacity) {
+					waits[index].waitFor("resources")
+					waiting = append(waiting, index)
+					continue
+				}
+
+				// the locks (and the server's resources) have to be free last, so the stage doesn't hold them while it can't
+				// start. A stage that started this run (through a pipeline stage) will never release its locks while waiting
+				// for it to finish
+				if lock, holder, held := SharedResources.heldByAncestor(ctx, stage.Locks); held {
+					logger.Error("Lock " + lock + " for stage: " + stage.Name + " is held by stage " + holder.Stage + " that started this run")
+					resolve(index, data.StageStatus["FAILED"], data.FailureReason["LOCK_ERROR"],
+						"lock '"+lock+"' is held by stage '"+holder.Stage+"' of pipeline '"+holder.Pipeline+"', which started this run")
+					progressed = true
+					continue
+				}
+
+				var holder = data.RunLink{Pipeline: pipeline.Name, Id: pipelineRun.Id, Stage: stage.Name}
+				if released, lockHeld := SharedResources.tryAcquire(stage, holder, serverCapacity); released != nil {
+					if lockHeld && waits[index].reason != "locks" {
+						logger.Info("Stage " + stage.Name + " is waiting for locks: " + strings.Join(stage.Locks, ", "))
+						waits[index].waitFor("locks")
+					} else if !lockHeld {
+						waits[index].waitFor("resources")
+					}
+					if sharedReleased == nil {
+						sharedReleased = released // the first one, any later ones are replaced by the time it's closed
+					}
+					waiting = append(waiting, index)
+					continue
+				}
+				waits[index].stop()
+				for name, amount := range stage.Resources {
+					resourcesInUse[name] += amount
+				}
+
+				// run task
+				stage.Shell = utils.ResolveShell(stage, pipeline)
+				stage.ExecutorConfig = utils.ResolveExecutor(stage, pipeline)
+				go func(index int, s data.Stage, wait stageWait) {
+					defer SharedResources.release(s)
+
+					// Create a "running" status and update pipelineRun immediately
+					taskResponse := data.TaskStatusResponse{TaskName: s.Name, Status: data.StageStatus["QUEUED"], StartedAt: time.Now(), ExitCode: -1,
+						Env: utils.MaskSecrets(s.Env), Matrix: s.MatrixValues, LockWaitMs: wait.locks.Milliseconds(), ResourceWaitMs: wait.resources.Milliseconds()}
+					transitionStage(&taskResponse, data.StageStatus["RUNNING"], logger)
+					updatePipelineRun(index, taskResponse)
 
-		// run task
-		go func(s data.Stage) {
-			defer taskWg.Done()
-			var start = time.Now()
+					// cleanup stages have to run to the end even when the run is cancelled or out of time,
+					// only their own timeout stops them
+					var stageCtx, stageDeadline = ctx, deadline
+					if isCleanupStage(s) {
+						stageCtx, stageDeadline = context.WithoutCancel(ctx), time.Time{}
+					}
 
-			// Create a "running" status and update pipelineRun immediately
-			runningTask := data.TaskStatusResponse{TaskName: s.Name, Successful: false, StartedAt: start}
-			updatePipelineRun(runningTask)
+					if err := restoreArtifacts(pipeline.Name, pipelineRun.Id, s, logger); err != nil {
+						logger.Error("Unable to restore artifacts for stage: " + s.Name + ": " + err.Error())
+						taskResponse.EndedAt = time.Now()
+						taskResponse.FailureReason = data.FailureReason["ARTIFACT_ERROR"]
+						taskResponse.Error = "unable to restore artifacts: " + err.Error()
+						transitionStage(&taskResponse, data.StageStatus["FAILED"], logger)
+						updatePipelineRun(index, taskResponse)
+						taskStatusBuffer <- taskResponse
+						return
+					}
 
-			// spawn process to run task
-			var successful, message = runTask(s, pipeline.Name)
-			if !successful {
-				logger.Error("Task failed: '" + s.Name + "' with message: " + message)
-				taskStatusBuffer <- data.TaskStatusResponse{TaskName: s.Name, Successful: false, StartedAt: start, EndedAt: time.Now()}
-			} else {
-				taskStatusBuffer <- data.TaskStatusResponse{TaskName: s.Name, Successful: true, StartedAt: start, EndedAt: time.Now()}
+					var cancelledWhileWaiting = false
+					for attempt := 1; ; attempt++ {
+						// spawn process to run task
+						var result data.TaskAttempt
+						if s.Pipeline != "" {
+							result = runSubPipeline(stageCtx, s, pipelineRun, attempt, stageTimeout(s, stageDeadline), logger)
+						} else {
+							result = runTask(stageCtx, s, pipeline.Name, attempt, stageTimeout(s, stageDeadline))
+						}
+						taskResponse.Attempts = append(taskResponse.Attempts, result)
+						if result.Successful {
+							break
+						}
+						if result.Cancelled {
+							logger.Warn("Task cancelled: '" + s.Name + "'")
+							break
+						}
+						logger.Error("Task failed: '" + s.Name + "' (attempt " + strconv.Itoa(attempt) + ") with message: " + result.Error)
+
+						delay, retry := retryDelay(s.Retry, result, stageDeadline)
+						if !retry {
+							break
+						}
+						updatePipelineRun(index, taskResponse) // show the failed attempt while waiting to retry
+						logger.Warn("Retrying task: '" + s.Name + "' in " + delay.String())
+						select {
+						case <-stageCtx.Done():
+							cancelledWhileWaiting = true
+						case <-time.After(delay):
+						}
+						if cancelledWhileWaiting {
+							break
+						}
+					}
+
+					// the stage's outcome is the outcome of its last attempt
+					var lastAttempt = taskResponse.Attempts[len(taskResponse.Attempts)-1]
+					taskResponse.EndedAt = lastAttempt.EndedAt
+					taskResponse.ExitCode = lastAttempt.ExitCode
+					taskResponse.Signal = lastAttempt.Signal
+					taskResponse.FailureReason = lastAttempt.FailureReason
+					taskResponse.Error = lastAttempt.Error
+					taskResponse.Outputs = lastAttempt.Outputs
+					taskResponse.ChildRun = lastAttempt.ChildRun
+					for _, attempt := range taskResponse.Attempts {
+						if attempt.Usage != nil {
+							taskResponse.Usage = addUsage(taskResponse.Usage, *attempt.Usage)
+						}
+					}
+					if cancelledWhileWaiting {
+						transitionStage(&taskResponse, data.StageStatus["CANCELLED"], logger)
+						taskResponse.FailureReason = data.FailureReason["CANCELLED"]
+						taskResponse.Error = "cancelled while waiting to retry"
+					} else if status := attemptStatus(s, lastAttempt); status == data.StageStatus["SUCCEEDED"] && len(s.Artifacts) > 0 {
+						// the stage only succeeds once its artifacts are stored, its dependents could need them
+						artifacts, err := saveArtifacts(pipeline.Name, pipelineRun.Id, s, logger)
+						taskResponse.Artifacts = artifacts
+						if err != nil {
+							logger.Error("Unable to store artifacts of stage: " + s.Name + ": " + err.Error())
+							status = data.StageStatus["FAILED"]
+							taskResponse.FailureReason = data.FailureReason["ARTIFACT_ERROR"]
+							taskResponse.Error = "unable to store artifacts: " + err.Error()
+						}
+						transitionStage(&taskResponse, status, logger)
+					} else {
+						transitionStage(&taskResponse, status, logger)
+					}
+
+					// downstream stages get the actual outputs, the run record gets them with secrets masked
+					var recordedResponse = taskResponse
+					recordedResponse.Outputs = utils.MaskSecretOutputs(taskResponse.Outputs)
+					updatePipelineRun(index, recordedResponse)
+					taskStatusBuffer <- taskResponse
+				}(index, stage, *waits[index])
+				logger.Info("Running task: " + stage.Name)
+
+				activeThreads++
+				if stage.MatrixOf != "" {
+					runningInstances[stage.MatrixOf]++
+				}
+				progressed = true
 			}
-		}(stage)
-		logger.Info("Running task: " + stage.Name)
 
-		taskWg.Add(1)
-		activeThreads++
+			pending = waiting
+		}
 
-		// if we have reached the maximum number of threads, wait for them to finish
-		if activeThreads >= threads {
-			logger.Debug("Pausing running new tasks, maximum threads reached")
-			collect(true)
-			logger.Debug("Resuming running new tasks")
+		if activeThreads == 0 && sharedReleased == nil {
+			// nothing is running and nothing could be started, the remaining stages can never run
+			// (validation should prevent this, but don't hang the run if it happens)
+			for _, index := range pending {
+				logger.Error("Stage " + stages[index].Name + " has unresolvable dependencies, marking as failed")
+				resolve(index, data.StageStatus["FAILED"], data.FailureReason["DEPENDENCY_FAILED"], "unresolvable dependencies")
+			}
+			break
 		}
-	}
 
-	collect(false)
+		// stages waiting for what other runs hold also have to notice the run being cancelled or running out of time
+		var cancelled <-chan struct{}
+		var timedOut <-chan time.Time
+		if sharedReleased != nil && ctx.Err() == nil {
+			cancelled = ctx.Done()
+		}
+		if sharedReleased != nil && !deadline.IsZero() && time.Now().Before(deadline) {
+			timedOut = time.After(time.Until(deadline))
+		}
+
+		// wait for the next running task to finish (or for another run to release something), then see what it unblocked
+		select {
+		case taskResponse := <-taskStatusBuffer:
+			var finishedStage = stages[slices.IndexFunc(stages, func(s data.Stage) bool { return s.Name == taskResponse.TaskName })]
+			finish(finishedStage, taskResponse)
+			activeThreads--
+			if finishedStage.MatrixOf != "" {
+				runningInstances[finishedStage.MatrixOf]--
+			}
+			for name, amount := range finishedStage.Resources {
+				resourcesInUse[name] -= amount
+			}
+		case <-sharedReleased:
+		case <-cancelled:
+		case <-timedOut:
+		}
+	}
 
 	pipelineRun.EndedAt = time.Now()
-	for _, response := range taskResponses {
-		updatePipelineRun(response) // this is probably redundant here, but safer to keep
-		if !response.Successful {
-			pipelineRun.Successful = false
+	var failed, cancelled, timedOut = false, false, false
+	for i, response := range pipelineRun.Stages {
+		if !data.StageStatusSuccessful(response.Status) {
+			failed = true
+		}
+		if response.Status == data.StageStatus["CANCELLED"] {
+			cancelled = true
 		}
+		if response.Status == data.StageStatus["FAILED_ALLOWED"] {
+			pipelineRun.Warnings++
+		}
+		// the run timed out if a stage had to be stopped at its deadline, or couldn't start (no end time) because of it
+		if !deadline.IsZero() && response.Status == data.StageStatus["TIMED_OUT"] && !isCleanupStage(stages[i]) &&
+			(response.EndedAt.IsZero() || !response.EndedAt.Before(deadline)) {
+			timedOut = true
+		}
+	}
+
+	if pipelineRun.Warnings > 0 {
+		logger.Warn(fmt.Sprint(pipelineRun.Warnings) + " stage(s) failed but were allowed to")
+	}
+
+	if cancelled {
+		transitionRun(pipelineRun, data.RunStatus["CANCELLED"], logger)
+	} else if timedOut {
+		transitionRun(pipelineRun, data.RunStatus["TIMED_OUT"], logger)
+	} else if failed {
+		transitionRun(pipelineRun, data.RunStatus["FAILED"], logger)
+	} else {
+		transitionRun(pipelineRun, data.RunStatus["SUCCEEDED"], logger)
 	}
 
 	if !savePipelineRun(*pipelineRun, logger) {
 		logger.Error("Error saving pipeline run for pipeline: " + pipeline.Name)
 	}
-	return pipelineRun.Successful, *pipelineRun
+	return pipelineRun.Status == data.RunStatus["SUCCEEDED"], *pipelineRun
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"pipeline/data"
 	"pipeline/utils"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var _ = os.Setenv("ENV", "test")
@@ -17,14 +22,57 @@ const testPipeline = "test_assets/test_pipeline_%s.json"
 const testSkipPipeline = "test_assets/test_pipeline_skip_%s.json"
 const testNoParallelPipeline = "test_assets/test_pipeline_no_parallel_%s.json"
 const testOverloadPipeline = "test_assets/test_pipeline_overload_%s.json"
+const testUnorderedPipeline = "test_assets/test_pipeline_unordered_%s.json"
+const testTimeoutPipeline = "test_assets/test_pipeline_timeout_%s.json"
+const testRetryPipeline = "test_assets/test_pipeline_retry_%s.json"
+const testShellPipeline = "test_assets/test_pipeline_shell_%s.json"
+const testEnvPipeline = "test_assets/test_pipeline_env_%s.json"
+const testFailurePipeline = "test_assets/test_pipeline_failure_%s.json"
+const testWhenPipeline = "test_assets/test_pipeline_when_%s.json"
+const testCleanupPipeline = "test_assets/test_pipeline_cleanup_%s.json"
+const testOutputsPipeline = "test_assets/test_pipeline_outputs_%s.json"
+const testArtifactsPipeline = "test_assets/test_pipeline_artifacts_%s.json"
+const testMatrixPipeline = "test_assets/test_pipeline_matrix_%s.json"
+const testStepsPipeline = "test_assets/test_pipeline_steps_%s.json"
+const testSubPipeline = "test_assets/test_pipeline_subpipeline_%s.json"
+const testSubPipelineChild = "test_assets/test_pipeline_subpipeline_child_%s.json"
+const testSubPipelineLoopA = "test_assets/test_pipeline_subpipeline_loop_a.json"
+const testSubPipelineLoopB = "test_assets/test_pipeline_subpipeline_loop_b.json"
+const testLocksPipeline = "test_assets/test_pipeline_locks_%s.json"
+const testLocksParentPipeline = "test_assets/test_pipeline_locks_parent_%s.json"
+const testLocksChildPipeline = "test_assets/test_pipeline_locks_child.json"
+const testResourcesPipeline = "test_assets/test_pipeline_resources_%s.json"
+const testServerResourcesPipeline = "test_assets/test_pipeline_resources_server_%s.json"
+const testLimitsPipeline = "test_assets/test_pipeline_limits_linux.json"
 
-func pipelineLoadHelper(pipelineFile string) data.Pipeline {
+var registerTestPipelines sync.Once
+
+func assetPathHelper(pipelineFile string) string {
 	var osSuffix = "linux"
 	if runtime.GOOS == "windows" {
 		osSuffix = "windows"
 	}
 
-	fileData, _ := os.ReadFile(fmt.Sprintf(pipelineFile, osSuffix))
+	if !strings.Contains(pipelineFile, "%s") {
+		return pipelineFile
+	}
+	return fmt.Sprintf(pipelineFile, osSuffix)
+}
+
+// registers the pipelines the pipeline stages of the test pipelines run, the tests share the registered pipelines file
+func registerPipelinesHelper(t *testing.T) {
+	registerTestPipelines.Do(func() {
+		var pipelines = map[string]data.RegisteredPipeline{}
+		for _, pipelineFile := range []string{testSubPipelineChild, testSubPipelineLoopA, testSubPipelineLoopB, testLocksChildPipeline} {
+			var pipeline = utils.LoadDefinition(assetPathHelper(pipelineFile), testLogger)
+			pipelines[pipeline.Name] = data.RegisteredPipeline{Name: pipeline.Name, Path: assetPathHelper(pipelineFile)}
+		}
+		utils.AssertTrue(t, saveRegisteredPipelines(pipelines, testLogger))
+	})
+}
+
+func pipelineLoadHelper(pipelineFile string) data.Pipeline {
+	fileData, _ := os.ReadFile(assetPathHelper(pipelineFile))
 
 	var pipeline data.Pipeline
 	_ = json.Unmarshal(fileData, &pipeline)
@@ -40,13 +88,13 @@ func Test_runPipeline_ShouldReturnSuccessWhenAllTasksCompleted(t *testing.T) {
 	var pipeline data.Pipeline = pipelineLoadHelper(testPipeline)
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	// assert
 	utils.AssertTrue(t, success)
-	utils.AssertTrue(t, pipelineRun.Successful)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
 	for _, taskResponse := range pipelineRun.Stages {
-		utils.AssertTrue(t, taskResponse.Successful)
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskResponse.Status)
 	}
 
 	// TODO: cleanup
@@ -60,34 +108,33 @@ func Test_runPipeline_ShouldReturnSuccessWhenAllTasksCompletedWhenPassingAPrecre
 	var pipelineRun data.PipelineRun
 
 	// act
-	var success, _ = runPipeline(&pipeline, &pipelineRun, testLogger)
+	var success, _ = runPipeline(context.Background(), &pipeline, &pipelineRun, testLogger)
 
 	// assert
 	utils.AssertTrue(t, success)
-	utils.AssertTrue(t, pipelineRun.Successful)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
 	for _, taskResponse := range pipelineRun.Stages {
-		utils.AssertTrue(t, taskResponse.Successful)
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskResponse.Status)
 	}
 
 	// TODO: cleanup
 }
 
-// this test would probably be effective (/testable) if we were able to set the number of threads as the caller (coming soon?)
-// technically the no parallel test, tests part of this
 func Test_runPipeline_ShouldReturnSuccessWhenRunningParallelAndMoreTaskThanThreads(t *testing.T) {
 	t.Parallel()
 
 	// arrange
 	var pipeline data.Pipeline = pipelineLoadHelper(testOverloadPipeline)
+	pipeline.MaxParallel = 2
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	// assert
 	utils.AssertTrue(t, success)
-	utils.AssertTrue(t, pipelineRun.Successful)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
 	for _, taskResponse := range pipelineRun.Stages {
-		utils.AssertTrue(t, taskResponse.Successful)
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskResponse.Status)
 	}
 
 	// TODO: cleanup
@@ -100,7 +147,7 @@ func Test_runPipeline_ShouldRespectOrderAndDependencies(t *testing.T) {
 	var pipeline data.Pipeline = pipelineLoadHelper(testPipeline)
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
 	for _, task := range pipelineRun.Stages {
@@ -134,13 +181,13 @@ func Test_runPipeline_ShouldReturnSuccessWhenAllTasksCompletedOrSetToSkip(t *tes
 	var pipeline data.Pipeline = pipelineLoadHelper(testSkipPipeline)
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	// assert
 	utils.AssertTrue(t, success)
-	utils.AssertTrue(t, pipelineRun.Successful)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
 	for _, taskResponse := range pipelineRun.Stages {
-		utils.AssertTrue(t, taskResponse.Successful)
+		utils.AssertTrue(t, data.StageStatusSuccessful(taskResponse.Status))
 	}
 
 	// TODO: cleanup
@@ -153,7 +200,7 @@ func Test_runPipeline_ShouldSkipDependentTasksWhenDependencyTasksSkipped(t *test
 	var pipeline data.Pipeline = pipelineLoadHelper(testSkipPipeline)
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
 	for _, task := range pipelineRun.Stages {
@@ -164,27 +211,23 @@ func Test_runPipeline_ShouldSkipDependentTasksWhenDependencyTasksSkipped(t *test
 	utils.AssertTrue(t, success)
 
 	// because security_scan is skipped all other dependent tasks (even transitively) should be skipped (but successful)
-	utils.AssertTrue(t, taskMap["security_scan"].Skipped)
-	utils.AssertTrue(t, taskMap["security_scan"].Successful)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["security_scan"].Status)
 	utils.AssertTrue(t, taskMap["security_scan"].StartedAt.IsZero())
-	utils.AssertTrue(t, taskMap["package"].Skipped)
-	utils.AssertTrue(t, taskMap["package"].Successful)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["package"].Status)
 	utils.AssertTrue(t, taskMap["package"].StartedAt.IsZero())
-	utils.AssertTrue(t, taskMap["deploy_staging"].Skipped)
-	utils.AssertTrue(t, taskMap["deploy_staging"].Successful)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["deploy_staging"].Status)
 	utils.AssertTrue(t, taskMap["deploy_staging"].StartedAt.IsZero())
-	utils.AssertTrue(t, taskMap["integration_tests"].Skipped)
-	utils.AssertTrue(t, taskMap["integration_tests"].Successful)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["integration_tests"].Status)
 	utils.AssertTrue(t, taskMap["integration_tests"].StartedAt.IsZero())
 
 	// verify other tasks were not skipped
-	utils.AssertFalse(t, taskMap["initialize"].Skipped)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["initialize"].Status)
 	utils.AssertFalse(t, taskMap["initialize"].StartedAt.IsZero())
-	utils.AssertFalse(t, taskMap["build_frontend"].Skipped)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["build_frontend"].Status)
 	utils.AssertFalse(t, taskMap["build_frontend"].StartedAt.IsZero())
-	utils.AssertFalse(t, taskMap["build_backend"].Skipped)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["build_backend"].Status)
 	utils.AssertFalse(t, taskMap["build_backend"].StartedAt.IsZero())
-	utils.AssertFalse(t, taskMap["run_tests"].Skipped)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["run_tests"].Status)
 	utils.AssertFalse(t, taskMap["run_tests"].StartedAt.IsZero())
 
 	// TODO: cleanup
@@ -197,7 +240,7 @@ func Test_runPipeline_ShouldRunSeriallyWhenParallelDisabled(t *testing.T) {
 	var pipeline data.Pipeline = pipelineLoadHelper(testNoParallelPipeline)
 
 	// act
-	var success, pipelineRun = runPipeline(&pipeline, nil, testLogger)
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
 
 	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
 	for _, task := range pipelineRun.Stages {
@@ -214,3 +257,1002 @@ func Test_runPipeline_ShouldRunSeriallyWhenParallelDisabled(t *testing.T) {
 
 	// TODO: cleanup
 }
+
+func Test_runPipeline_ShouldRespectDependenciesRegardlessOfStageOrder(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testUnorderedPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertEqual(t, 4, len(pipelineRun.Stages))
+	for _, taskResponse := range pipelineRun.Stages {
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskResponse.Status)
+	}
+
+	// stages are defined in reverse, but should still only start once their dependencies end
+	utils.AssertGreaterThanOrEqualTo(t, int(taskMap["initialize"].EndedAt.UnixMilli()), int(taskMap["build_frontend"].StartedAt.UnixMilli()))
+	utils.AssertGreaterThanOrEqualTo(t, int(taskMap["initialize"].EndedAt.UnixMilli()), int(taskMap["build_backend"].StartedAt.UnixMilli()))
+	utils.AssertGreaterThanOrEqualTo(t, int(taskMap["build_frontend"].EndedAt.UnixMilli()), int(taskMap["package"].StartedAt.UnixMilli()))
+	utils.AssertGreaterThanOrEqualTo(t, int(taskMap["build_backend"].EndedAt.UnixMilli()), int(taskMap["package"].StartedAt.UnixMilli()))
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldStopStageAndMarkItTimedOutWhenStageTimeoutExpires(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testTimeoutPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.RunStatus["FAILED"], pipelineRun.Status)
+
+	utils.AssertStringEqual(t, data.StageStatus["TIMED_OUT"], taskMap["hang"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["TIMEOUT"], taskMap["hang"].FailureReason)
+	// the task (and the sleep it spawned) should be stopped well before it would have finished on its own
+	utils.AssertLessThan(t, int((TERMINATE_GRACE_PERIOD).Milliseconds()), int(taskMap["hang"].EndedAt.Sub(taskMap["hang"].StartedAt).Milliseconds()))
+
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], taskMap["after_hang"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["DEPENDENCY_FAILED"], taskMap["after_hang"].FailureReason)
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["quick"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldStopRunWhenPipelineTimeoutExpires(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testPipeline)
+	pipeline.Timeout = "2s"
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	var timedOut = 0
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+		if task.Status == data.StageStatus["TIMED_OUT"] {
+			timedOut++
+		}
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.RunStatus["TIMED_OUT"], pipelineRun.Status)
+	utils.AssertLessThan(t, int((TERMINATE_GRACE_PERIOD).Milliseconds()), int(pipelineRun.EndedAt.Sub(pipelineRun.StartedAt).Milliseconds()))
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["initialize"].Status)
+	utils.AssertMin(t, 1, timedOut)
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], taskMap["integration_tests"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRetryFailedStagesAndRecordEachAttempt(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testRetryPipeline)
+	pipeline.Stages[0].Pwd = t.TempDir() // where the flaky stage keeps track of whether it already failed
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	// fails the first time, then succeeds on the retry
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["flaky"].Status)
+	utils.AssertEqual(t, 2, len(taskMap["flaky"].Attempts))
+	utils.AssertFalse(t, taskMap["flaky"].Attempts[0].Successful)
+	utils.AssertEqual(t, 3, taskMap["flaky"].Attempts[0].ExitCode)
+	utils.AssertTrue(t, taskMap["flaky"].Attempts[1].Successful)
+	utils.AssertEqual(t, 0, taskMap["flaky"].Attempts[1].ExitCode)
+	utils.AssertTrue(t, taskMap["flaky"].Attempts[0].LogFile != taskMap["flaky"].Attempts[1].LogFile)
+	utils.AssertFalse(t, taskMap["flaky"].Attempts[1].StartedAt.Before(taskMap["flaky"].Attempts[0].EndedAt))
+
+	// retried until it runs out of attempts
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["always_fails"].Status)
+	utils.AssertEqual(t, 3, len(taskMap["always_fails"].Attempts))
+	for i, attempt := range taskMap["always_fails"].Attempts {
+		utils.AssertEqual(t, i+1, attempt.Attempt)
+		utils.AssertEqual(t, 4, attempt.ExitCode)
+	}
+
+	// exit code isn't one of the retryable ones
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["not_retryable"].Status)
+	utils.AssertEqual(t, 1, len(taskMap["not_retryable"].Attempts))
+
+	// TODO: cleanup
+}
+
+func Test_retryDelay_ShouldNotRetryWithoutPolicyOrWhenOutOfAttempts(t *testing.T) {
+	// act
+	var _, retryNoPolicy = retryDelay(nil, data.TaskAttempt{Attempt: 1, ExitCode: 1}, time.Time{})
+	var _, retryOutOfAttempts = retryDelay(&data.RetryPolicy{MaxAttempts: 2}, data.TaskAttempt{Attempt: 2, ExitCode: 1}, time.Time{})
+	var _, retryWithAttempts = retryDelay(&data.RetryPolicy{MaxAttempts: 2}, data.TaskAttempt{Attempt: 1, ExitCode: 1}, time.Time{})
+
+	// assert
+	utils.AssertFalse(t, retryNoPolicy)
+	utils.AssertFalse(t, retryOutOfAttempts)
+	utils.AssertTrue(t, retryWithAttempts)
+}
+
+func Test_retryDelay_ShouldOnlyRetryListedExitCodes(t *testing.T) {
+	// arrange
+	var policy = data.RetryPolicy{MaxAttempts: 5, ExitCodes: []int{2, 75}}
+
+	// act
+	var _, retryListed = retryDelay(&policy, data.TaskAttempt{Attempt: 1, ExitCode: 75}, time.Time{})
+	var _, retryNotListed = retryDelay(&policy, data.TaskAttempt{Attempt: 1, ExitCode: 1}, time.Time{})
+	var _, retryTimedOut = retryDelay(&policy, data.TaskAttempt{Attempt: 1, ExitCode: -1, TimedOut: true}, time.Time{})
+
+	// assert
+	utils.AssertTrue(t, retryListed)
+	utils.AssertFalse(t, retryNotListed)
+	utils.AssertFalse(t, retryTimedOut)
+}
+
+func Test_retryDelay_ShouldUseFixedOrExponentialBackoff(t *testing.T) {
+	// arrange
+	var fixed = data.RetryPolicy{MaxAttempts: 10, Delay: "2s"}
+	var exponential = data.RetryPolicy{MaxAttempts: 10, Backoff: "exponential", Delay: "2s", MaxDelay: "10s"}
+
+	// act
+	var fixedDelay, _ = retryDelay(&fixed, data.TaskAttempt{Attempt: 3}, time.Time{})
+	var exponentialDelay1, _ = retryDelay(&exponential, data.TaskAttempt{Attempt: 1}, time.Time{})
+	var exponentialDelay3, _ = retryDelay(&exponential, data.TaskAttempt{Attempt: 3}, time.Time{})
+	var exponentialDelay5, _ = retryDelay(&exponential, data.TaskAttempt{Attempt: 5}, time.Time{})
+
+	// assert
+	utils.AssertEqual(t, 2000, int(fixedDelay.Milliseconds()))
+	utils.AssertEqual(t, 2000, int(exponentialDelay1.Milliseconds()))
+	utils.AssertEqual(t, 8000, int(exponentialDelay3.Milliseconds()))
+	utils.AssertEqual(t, 10000, int(exponentialDelay5.Milliseconds())) // capped by max_delay
+}
+
+func Test_retryDelay_ShouldKeepJitteredDelayBetweenHalfAndFullDelay(t *testing.T) {
+	// arrange
+	var policy = data.RetryPolicy{MaxAttempts: 10, Delay: "1s", Jitter: true}
+
+	for i := 0; i < 20; i++ {
+		// act
+		var delay, _ = retryDelay(&policy, data.TaskAttempt{Attempt: 1}, time.Time{})
+
+		// assert
+		utils.AssertGreaterThanOrEqualTo(t, 500, int(delay.Milliseconds()))
+		utils.AssertLessThanOrEqualTo(t, 1000, int(delay.Milliseconds()))
+	}
+}
+
+func Test_retryDelay_ShouldNotRetryPastTheRunDeadline(t *testing.T) {
+	// arrange
+	var policy = data.RetryPolicy{MaxAttempts: 3, Delay: "1m"}
+
+	// act
+	var _, retry = retryDelay(&policy, data.TaskAttempt{Attempt: 1}, time.Now().Add(30*time.Second))
+
+	// assert
+	utils.AssertFalse(t, retry)
+}
+
+func Test_runPipeline_ShouldStopRunningStagesAndCancelPendingStagesWhenCancelled(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testPipeline)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(2*time.Second, cancel) // initialize takes 1 second, the build stages 3+
+
+	// act
+	var success, pipelineRun = runPipeline(ctx, &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.RunStatus["CANCELLED"], pipelineRun.Status)
+	utils.AssertLessThan(t, int((TERMINATE_GRACE_PERIOD).Milliseconds()), int(pipelineRun.EndedAt.Sub(pipelineRun.StartedAt).Milliseconds()))
+	utils.AssertEqual(t, len(pipeline.Stages), len(pipelineRun.Stages))
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["initialize"].Status)
+
+	// was running when the run got cancelled
+	utils.AssertStringEqual(t, data.StageStatus["CANCELLED"], taskMap["build_frontend"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["CANCELLED"], taskMap["build_frontend"].FailureReason)
+	utils.AssertFalse(t, taskMap["build_frontend"].StartedAt.IsZero())
+
+	// never got to start
+	utils.AssertStringEqual(t, data.StageStatus["CANCELLED"], taskMap["integration_tests"].Status)
+	utils.AssertTrue(t, taskMap["integration_tests"].StartedAt.IsZero())
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunIndependentStagesAtTheSameTimeUpToMaxParallel(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testUnorderedPipeline)
+	pipeline.MaxParallel = 2
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertEqual(t, 2, pipelineRun.MaxParallel)
+
+	// both builds only depend on initialize, so they should overlap
+	utils.AssertTrue(t, taskMap["build_backend"].StartedAt.Before(taskMap["build_frontend"].EndedAt))
+	utils.AssertTrue(t, taskMap["build_frontend"].StartedAt.Before(taskMap["build_backend"].EndedAt))
+
+	// TODO: cleanup
+}
+
+func Test_resolveThreads_ShouldUseOneThreadWhenNotParallel(t *testing.T) {
+	// act
+	var threads = resolveThreads(&data.Pipeline{Parallel: false, MaxParallel: 8}, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 1, threads)
+}
+
+func Test_resolveThreads_ShouldUseMaxParallelOrHalfTheCPUs(t *testing.T) {
+	// act
+	var configured = resolveThreads(&data.Pipeline{Parallel: true, MaxParallel: 6}, testLogger)
+	var defaulted = resolveThreads(&data.Pipeline{Parallel: true}, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 6, configured)
+	utils.AssertEqual(t, max(1, runtime.NumCPU()/2), defaulted)
+}
+
+func Test_resolveThreads_ShouldBeCappedByMaxParallelEnvVar(t *testing.T) {
+	// arrange
+	t.Setenv("MAX_PARALLEL", "3")
+
+	// act
+	var capped = resolveThreads(&data.Pipeline{Parallel: true, MaxParallel: 32}, testLogger)
+	var underCap = resolveThreads(&data.Pipeline{Parallel: true, MaxParallel: 2}, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 3, capped)
+	utils.AssertEqual(t, 2, underCap)
+}
+
+func Test_resolveThreads_ShouldIgnoreInvalidMaxParallelEnvVar(t *testing.T) {
+	// arrange
+	t.Setenv("MAX_PARALLEL", "lots")
+
+	// act
+	var threads = resolveThreads(&data.Pipeline{Parallel: true, MaxParallel: 5}, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 5, threads)
+}
+
+func Test_runPipeline_ShouldRunTasksThroughShellWhenSet(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testShellPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var logs map[string]string = make(map[string]string)
+	for _, task := range pipelineRun.Stages {
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], task.Status)
+		var output, _ = os.ReadFile(task.Attempts[0].LogFile)
+		logs[task.TaskName] = strings.ReplaceAll(string(output), "\r", "")
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertTrue(t, strings.Contains(logs["pipes"], "HELLO WORLD\nsecond"))
+	utils.AssertTrue(t, strings.Contains(logs["with_args"], "a b\nit's"))
+	utils.AssertTrue(t, strings.Contains(logs["no_shell"], "direct"))
+	if runtime.GOOS == "windows" {
+		// cmd gets the quoted args as they are, without exec's escaping
+		utils.AssertTrue(t, strings.Contains(logs["cmd_quotes"], `"a b" "say ""hi"""`))
+	}
+
+	// TODO: cleanup
+}
+
+func Test_buildCommand_ShouldRunTaskDirectlyWithoutShell(t *testing.T) {
+	// act
+	var cmd = buildCommand(data.Stage{Task: "node", Args: []string{"index.js", "--flag"}})
+
+	// assert
+	utils.AssertSliceEqual(t, []string{"node", "index.js", "--flag"}, cmd.Args)
+}
+
+func Test_buildCommand_ShouldRunTaskThroughShellWithQuotedArgs(t *testing.T) {
+	// act
+	var cmd = buildCommand(data.Stage{Task: "node index.js | tee out.txt", Args: []string{"a b", "it's"}, Shell: "bash"})
+
+	// assert
+	utils.AssertSliceEqual(t, []string{"bash", "-c", "node index.js | tee out.txt 'a b' 'it'\\''s'"}, cmd.Args)
+}
+
+func Test_runPipeline_ShouldMergeInheritedPipelineAndStageEnv(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_INHERITED", "inherited")
+	var pipeline data.Pipeline = pipelineLoadHelper(testEnvPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+	var output, _ = os.ReadFile(pipelineRun.Stages[0].Attempts[0].LogFile)
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertTrue(t, strings.Contains(string(output), "inherited pipeline stage hunter2"))
+
+	// the run record has the resolved env, without the secret
+	utils.AssertContains(t, pipelineRun.Stages[0].Env, "PIPELINE_TEST_INHERITED=inherited")
+	utils.AssertContains(t, pipelineRun.Stages[0].Env, "LEVEL=pipeline")
+	utils.AssertContains(t, pipelineRun.Stages[0].Env, "OVERRIDE=stage")
+	utils.AssertContains(t, pipelineRun.Stages[0].Env, "API_TOKEN="+utils.MASKED_VALUE)
+	utils.AssertNotContains(t, pipelineRun.Stages[0].Env, "API_TOKEN=hunter2")
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRecordWhyStagesFailed(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testFailurePipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	utils.AssertStringEqual(t, data.FailureReason["SPAWN_ERROR"], taskMap["missing_executable"].FailureReason)
+	utils.AssertEqual(t, -1, taskMap["missing_executable"].ExitCode)
+	utils.AssertFalse(t, taskMap["missing_executable"].Error == "")
+
+	utils.AssertStringEqual(t, data.FailureReason["NON_ZERO_EXIT"], taskMap["exit_code"].FailureReason)
+	utils.AssertEqual(t, 3, taskMap["exit_code"].ExitCode)
+	utils.AssertStringEqual(t, "", taskMap["exit_code"].Signal)
+	utils.AssertStringEqual(t, "exit status 3", taskMap["exit_code"].Error)
+
+	utils.AssertStringEqual(t, data.FailureReason["NON_ZERO_EXIT"], taskMap["signalled"].FailureReason)
+	if runtime.GOOS != "windows" {
+		utils.AssertEqual(t, -1, taskMap["signalled"].ExitCode)
+		utils.AssertStringEqual(t, "SIGKILL", taskMap["signalled"].Signal)
+	}
+
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], taskMap["after_failure"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["DEPENDENCY_FAILED"], taskMap["after_failure"].FailureReason)
+	utils.AssertEqual(t, -1, taskMap["after_failure"].ExitCode)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldSkipStagesWhenTheirConditionIsNotMet(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testWhenPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["build"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["quick_only"].Status)
+
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["full_only"].Status)
+	utils.AssertStringEqual(t, "condition not met: stages.build.status == 'success' && {env.PIPELINE_MODE} == 'full'", taskMap["full_only"].SkipReason)
+	utils.AssertTrue(t, taskMap["full_only"].StartedAt.IsZero())
+
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["after_full"].Status)
+	utils.AssertStringEqual(t, "a dependency was skipped", taskMap["after_full"].SkipReason)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldPassStageOutputsToDownstreamStages(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testOutputsPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["discover"].Status)
+	utils.AssertStringEqual(t, "3", taskMap["discover"].Outputs["new_count"])
+	utils.AssertStringEqual(t, "incoming", taskMap["discover"].Outputs["dir"])
+	utils.AssertStringEqual(t, utils.MASKED_VALUE, taskMap["discover"].Outputs["api_token"])
+
+	// checks it got the values, including the actual value of the masked one
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["transcode"].Status)
+
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["report"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["VARIABLE_ERROR"], taskMap["report"].FailureReason)
+	utils.AssertStringEqual(t, "Missing output: stages.discover.deleted_count", taskMap["report"].Error)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldStoreArtifactsAndRestoreThemForStagesThatNeedThem(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testArtifactsPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+	var artifacts = loadArtifacts(pipeline.Name, pipelineRun.Id, testLogger)
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], pipelineRun.Stages[0].Status)
+	utils.AssertSliceEqual(t, []string{"test_pipeline_run_artifacts/out/report.txt", "test_pipeline_run_artifacts/out/maps/similarity.json"},
+		pipelineRun.Stages[0].Artifacts)
+
+	// the stage checks it got the artifacts, and not the file that wasn't one
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], pipelineRun.Stages[1].Status)
+
+	utils.AssertEqual(t, 2, len(artifacts))
+	for _, artifact := range artifacts {
+		utils.AssertStringEqual(t, "produce", artifact.Stage)
+		utils.AssertGreaterThan(t, 0, int(artifact.Size))
+	}
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunAnInstanceOfMatrixStagesForEveryCombination(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testMatrixPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertEqual(t, 10, len(pipelineRun.Stages))
+
+	var instances []data.TaskStatusResponse
+	for _, lang := range []string{"en", "es", "fr"} {
+		for _, model := range []string{"small", "large"} {
+			var instance = taskMap["transcribe (lang="+lang+", model="+model+")"]
+			utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], instance.Status)
+			utils.AssertStringEqual(t, lang, instance.Matrix["lang"])
+			utils.AssertStringEqual(t, model, instance.Matrix["model"])
+
+			var logData, _ = os.ReadFile(instance.Attempts[0].LogFile)
+			utils.AssertStringEqual(t, lang+"-"+model+"\n", string(logData))
+			instances = append(instances, instance)
+		}
+	}
+
+	// no more than max_parallel instances ran at once, and the dependent waited for all of them
+	for _, instance := range instances {
+		var running = 0
+		for _, other := range instances {
+			if !other.StartedAt.After(instance.StartedAt) && other.EndedAt.After(instance.StartedAt) {
+				running++
+			}
+		}
+		utils.AssertLessThanOrEqualTo(t, 2, running)
+		utils.AssertTrue(t, taskMap["report"].StartedAt.After(instance.EndedAt))
+	}
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["report"].Status)
+
+	// one failed instance fails the matrix stage for its dependents
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["translate (lang=en)"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["translate (lang=xx)"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], taskMap["publish"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunStepsInOrderAndStopAtTheFirstThatFails(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testStepsPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	var build = taskMap["build"]
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], build.Status)
+	utils.AssertStringEqual(t, "yes", build.Outputs["built"])
+	utils.AssertEqual(t, 3, len(build.Attempts[0].Steps))
+
+	var stepNames []string
+	var stepCpuMs int64
+	for i, step := range build.Attempts[0].Steps {
+		stepNames = append(stepNames, step.Name)
+		stepCpuMs += step.Usage.UserCpuMs + step.Usage.SystemCpuMs
+		utils.AssertEqual(t, 0, step.ExitCode)
+		utils.AssertFalse(t, step.EndedAt.Before(step.StartedAt))
+		if i > 0 {
+			utils.AssertFalse(t, step.StartedAt.Before(build.Attempts[0].Steps[i-1].EndedAt))
+		}
+	}
+	utils.AssertSliceEqual(t, []string{"prepare", "step 2", "package"}, stepNames)
+	utils.AssertEqual(t, int(stepCpuMs), int(build.Attempts[0].Usage.UserCpuMs+build.Attempts[0].Usage.SystemCpuMs))
+
+	var logData, _ = os.ReadFile(build.Attempts[0].LogFile)
+	utils.AssertStringEqual(t, "==> prepare\npreparing\n==> step 2\n::set-output built=yes\n==> package\npackaging\n",
+		strings.ReplaceAll(string(logData), "\r\n", "\n"))
+
+	var lint = taskMap["lint"]
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], lint.Status)
+	utils.AssertEqual(t, 3, lint.ExitCode)
+	utils.AssertStringEqual(t, "step 'check': exit status 3", lint.Error)
+	utils.AssertEqual(t, 1, len(lint.Attempts[0].Steps))
+	utils.AssertStringEqual(t, "check", lint.Attempts[0].Steps[0].Name)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunRegisteredPipelinesOfPipelineStagesAndLinkTheirRuns(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testSubPipeline)
+	const child = "test_pipeline_run_subpipeline_child"
+	const loopA = "test_pipeline_run_subpipeline_loop_a"
+	const loopB = "test_pipeline_run_subpipeline_loop_b"
+	registerPipelinesHelper(t)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	var nightly = taskMap["nightly"]
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], nightly.Status)
+	utils.AssertStringEqual(t, child, nightly.ChildRun.Pipeline)
+
+	var childRuns = loadPipelineRuns(testLogger, child, NUM_LAST_RUNS)
+	var childRunIndex = slices.IndexFunc(childRuns, func(run data.PipelineRun) bool { return run.Id == nightly.ChildRun.Id })
+	utils.AssertTrue(t, childRunIndex != -1)
+	var childRun = childRuns[childRunIndex]
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], childRun.Status)
+	utils.AssertStringEqual(t, pipeline.Name, childRun.ParentRun.Pipeline)
+	utils.AssertStringEqual(t, pipelineRun.Id, childRun.ParentRun.Id)
+	utils.AssertStringEqual(t, "nightly", childRun.ParentRun.Stage)
+
+	// the variables the stage passes replace the child's
+	var logData, _ = os.ReadFile(childRun.Stages[0].Attempts[0].LogFile)
+	utils.AssertStringEqual(t, "hello world", strings.TrimSpace(string(logData)))
+
+	var broken = taskMap["broken"]
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], broken.Status)
+	utils.AssertStringEqual(t, data.FailureReason["PIPELINE_FAILED"], broken.FailureReason)
+	utils.AssertStringEqual(t, "pipeline '"+child+"' failed at stage 'check': exit status 1", broken.Error)
+	utils.AssertTrue(t, broken.ChildRun != nil && broken.ChildRun.Id != nightly.ChildRun.Id)
+
+	var missing = taskMap["missing"]
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], missing.Status)
+	utils.AssertStringEqual(t, data.FailureReason["PIPELINE_ERROR"], missing.FailureReason)
+	utils.AssertStringEqual(t, "Pipeline with name 'test_pipeline_run_not_registered' does not exist", missing.Error)
+	utils.AssertTrue(t, missing.ChildRun == nil)
+
+	// loop_a runs loop_b, which would run loop_a again
+	var loop = taskMap["loop"]
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], loop.Status)
+	utils.AssertStringEqual(t, "pipeline '"+loopA+"' failed at stage 'call_b': pipeline '"+loopB+"' failed at stage 'call_a': "+
+		"can't run pipeline '"+loopA+"' recursively: "+pipeline.Name+" -> "+loopA+" -> "+loopB+" -> "+loopA, loop.Error)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldNotRunStagesHoldingTheSameLockAtTheSameTime(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipelines = []data.Pipeline{pipelineLoadHelper(testLocksPipeline), pipelineLoadHelper(testLocksPipeline)}
+	var pipelineRuns = make([]data.PipelineRun, len(pipelines))
+
+	// act
+	var wg sync.WaitGroup
+	for i := range pipelines {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, pipelineRuns[i] = runPipeline(context.Background(), &pipelines[i], nil, testLogger)
+		}(i)
+	}
+	wg.Wait()
+
+	// assert
+	var locked []data.TaskStatusResponse
+	for _, pipelineRun := range pipelineRuns {
+		utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
+		for _, stage := range pipelineRun.Stages {
+			if stage.TaskName != "read" {
+				locked = append(locked, stage)
+			}
+		}
+	}
+
+	// the stages holding the db lock ran one after the other, within and across the runs, and the later ones waited
+	slices.SortFunc(locked, func(a, b data.TaskStatusResponse) int { return a.StartedAt.Compare(b.StartedAt) })
+	utils.AssertEqual(t, 4, len(locked))
+	for i := 1; i < len(locked); i++ {
+		utils.AssertFalse(t, locked[i].StartedAt.Before(locked[i-1].EndedAt))
+		utils.AssertGreaterThan(t, 0, int(locked[i].LockWaitMs))
+	}
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldFailStagesThatNeedALockHeldByTheStageThatStartedTheirRun(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testLocksParentPipeline)
+	registerPipelinesHelper(t)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+	var childRuns = loadPipelineRuns(testLogger, "test_pipeline_run_locks_child", NUM_LAST_RUNS)
+	var childRunIndex = slices.IndexFunc(childRuns, func(run data.PipelineRun) bool { return run.Id == pipelineRun.Stages[0].ChildRun.Id })
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.FailureReason["PIPELINE_FAILED"], pipelineRun.Stages[0].FailureReason)
+	utils.AssertTrue(t, childRunIndex != -1)
+
+	var writeIndex = childRuns[childRunIndex].Stages[0]
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], writeIndex.Status)
+	utils.AssertStringEqual(t, data.FailureReason["LOCK_ERROR"], writeIndex.FailureReason)
+	utils.AssertStringEqual(t, "lock 'test_pipeline_run_locks_index' is held by stage 'reindex' of pipeline '"+pipeline.Name+"', which started this run",
+		writeIndex.Error)
+
+	// the lock is released once the stage is done
+	_, held := SharedResources.heldBy("test_pipeline_run_locks_index")
+	utils.AssertFalse(t, held)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldNotRunStagesNeedingMoreThanThePipelinesCapacityAtOnce(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testResourcesPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+
+	// transcribe (3 cpu) and tag (1 cpu) fill the capacity of 4, embed (2 cpu) has to wait for transcribe
+	utils.AssertTrue(t, taskMap["tag"].StartedAt.Before(taskMap["transcribe"].EndedAt))
+	utils.AssertFalse(t, taskMap["embed"].StartedAt.Before(taskMap["transcribe"].EndedAt))
+	utils.AssertGreaterThan(t, 0, int(taskMap["embed"].ResourceWaitMs))
+	utils.AssertEqual(t, 0, int(taskMap["transcribe"].ResourceWaitMs))
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldShareTheServersCapacityBetweenRuns(t *testing.T) {
+	// arrange
+	t.Setenv("RESOURCE_CAPACITY", "test_pipeline_run_gpu=1")
+	var pipelines = []data.Pipeline{pipelineLoadHelper(testServerResourcesPipeline), pipelineLoadHelper(testServerResourcesPipeline)}
+	var pipelineRuns = make([]data.PipelineRun, len(pipelines))
+
+	// act
+	var wg sync.WaitGroup
+	for i := range pipelines {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, pipelineRuns[i] = runPipeline(context.Background(), &pipelines[i], nil, testLogger)
+		}(i)
+	}
+	wg.Wait()
+
+	// assert
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRuns[0].Status)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRuns[1].Status)
+
+	var first, second = pipelineRuns[0].Stages[0], pipelineRuns[1].Stages[0]
+	if second.StartedAt.Before(first.StartedAt) {
+		first, second = second, first
+	}
+	utils.AssertFalse(t, second.StartedAt.Before(first.EndedAt))
+	utils.AssertGreaterThan(t, 0, int(second.ResourceWaitMs))
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldApplyTheLimitsOfStagesToTheirProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only applied on linux")
+	}
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testLimitsPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["open_files"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["nice"].Status)
+	utils.AssertEqual(t, 0, len(taskMap["nice"].Attempts[0].Limits.Warnings))
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["io_priority"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["io_level_default"].Status)
+	utils.AssertEqual(t, 0, len(taskMap["open_files"].Attempts[0].Limits.Warnings))
+
+	// the loop is stopped by its cpu time limit long before its timeout
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["cpu_time"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["LIMIT_EXCEEDED"], taskMap["cpu_time"].FailureReason)
+	utils.AssertStringEqual(t, "SIGXCPU", taskMap["cpu_time"].Signal)
+	utils.AssertGreaterThan(t, 500, int(taskMap["cpu_time"].Attempts[0].Limits.CpuTimeMs))
+
+	// tail needs more memory than it's allowed, whether it's OOM killed in a cgroup or fails to allocate it
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["memory"].Status)
+	utils.AssertEqual(t, 64, taskMap["memory"].Attempts[0].Limits.Limits.MemoryMB)
+	utils.AssertGreaterThan(t, 0, int(taskMap["memory"].Attempts[0].Limits.PeakMemoryKB))
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRecordWhatTheProcessesOfEachStageUsed(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testRetryPipeline)
+	pipeline.Stages[0].Pwd = t.TempDir()
+
+	// act
+	var _, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	// the stage's usage is of all of its attempts
+	var stage = taskMap["always_fails"]
+	utils.AssertEqual(t, 3, len(stage.Attempts))
+	var cpuMs, contextSwitches, maxRssKB int64
+	for _, attempt := range stage.Attempts {
+		utils.AssertTrue(t, attempt.Usage != nil)
+		cpuMs += attempt.Usage.UserCpuMs + attempt.Usage.SystemCpuMs
+		contextSwitches += attempt.Usage.VoluntaryContextSwitches + attempt.Usage.InvoluntaryContextSwitches
+		maxRssKB = max(maxRssKB, attempt.Usage.MaxRssKB)
+	}
+	utils.AssertTrue(t, stage.Usage != nil)
+	utils.AssertEqual(t, int(cpuMs), int(stage.Usage.UserCpuMs+stage.Usage.SystemCpuMs))
+	utils.AssertEqual(t, int(contextSwitches), int(stage.Usage.VoluntaryContextSwitches+stage.Usage.InvoluntaryContextSwitches))
+	utils.AssertEqual(t, int(maxRssKB), int(stage.Usage.MaxRssKB))
+	if runtime.GOOS != "windows" {
+		utils.AssertGreaterThan(t, 0, int(stage.Usage.MaxRssKB))
+	}
+
+	utils.AssertTrue(t, taskMap["not_retryable"].Usage != nil)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunCleanupStagesBasedOnRunOn(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testCleanupPipeline)
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+	utils.AssertStringEqual(t, data.RunStatus["FAILED"], pipelineRun.Status)
+
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], taskMap["build"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], taskMap["deploy"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["on_build_failure"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["check"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["on_check_failure"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["cleanup"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldRunCleanupStagesAfterCancellationOrTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, stop := range []string{"cancel", "timeout"} {
+		// arrange
+		var pipeline data.Pipeline = pipelineLoadHelper(testPipeline)
+		var cleanup = pipeline.Stages[0] // initialize, takes about a second
+		cleanup.Name = "cleanup"
+		cleanup.RunOn = "always"
+		cleanup.DependsOn = []string{"build_frontend", "integration_tests"}
+		pipeline.Stages = append(pipeline.Stages, cleanup)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if stop == "cancel" {
+			time.AfterFunc(2*time.Second, cancel) // initialize takes 1 second, the build stages 3+
+		} else {
+			pipeline.Timeout = "2s"
+		}
+
+		// act
+		var success, pipelineRun = runPipeline(ctx, &pipeline, nil, testLogger)
+		cancel()
+
+		var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+		for _, task := range pipelineRun.Stages {
+			taskMap[task.TaskName] = task
+		}
+
+		// assert
+		utils.AssertFalse(t, success)
+		if stop == "cancel" {
+			utils.AssertStringEqual(t, data.RunStatus["CANCELLED"], pipelineRun.Status)
+		} else {
+			utils.AssertStringEqual(t, data.RunStatus["TIMED_OUT"], pipelineRun.Status)
+		}
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["cleanup"].Status)
+		utils.AssertFalse(t, taskMap["cleanup"].StartedAt.Before(taskMap["build_frontend"].EndedAt))
+	}
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldNotFailRunOrDependentsWhenStageIsAllowedToFail(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testCleanupPipeline)
+	pipeline.Stages[0].AllowFailure = true // build
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertTrue(t, success)
+	utils.AssertStringEqual(t, data.RunStatus["SUCCEEDED"], pipelineRun.Status)
+	utils.AssertEqual(t, 1, pipelineRun.Warnings)
+
+	utils.AssertStringEqual(t, data.StageStatus["FAILED_ALLOWED"], taskMap["build"].Status)
+	utils.AssertStringEqual(t, data.FailureReason["NON_ZERO_EXIT"], taskMap["build"].FailureReason)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["deploy"].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], taskMap["on_build_failure"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_transitionStage_ShouldOnlyAllowDefinedTransitions(t *testing.T) {
+	// arrange
+	var response = data.TaskStatusResponse{TaskName: "stage", Status: data.StageStatus["QUEUED"]}
+
+	// act & assert
+	utils.AssertFalse(t, transitionStage(&response, data.StageStatus["SUCCEEDED"], testLogger)) // has to run first
+	utils.AssertStringEqual(t, data.StageStatus["QUEUED"], response.Status)
+
+	utils.AssertTrue(t, transitionStage(&response, data.StageStatus["RUNNING"], testLogger))
+	utils.AssertTrue(t, transitionStage(&response, data.StageStatus["FAILED"], testLogger))
+
+	// a finished stage can't be changed
+	utils.AssertFalse(t, transitionStage(&response, data.StageStatus["SUCCEEDED"], testLogger))
+	utils.AssertStringEqual(t, data.StageStatus["FAILED"], response.Status)
+}
+
+func Test_transitionRun_ShouldOnlyAllowDefinedTransitions(t *testing.T) {
+	// arrange
+	var pipelineRun = data.PipelineRun{Status: data.RunStatus["QUEUED"]}
+
+	// act & assert
+	utils.AssertFalse(t, transitionRun(&pipelineRun, data.RunStatus["SUCCEEDED"], testLogger))
+	utils.AssertTrue(t, transitionRun(&pipelineRun, data.RunStatus["RUNNING"], testLogger))
+	utils.AssertTrue(t, transitionRun(&pipelineRun, data.RunStatus["CANCELLED"], testLogger))
+	utils.AssertFalse(t, transitionRun(&pipelineRun, data.RunStatus["RUNNING"], testLogger))
+	utils.AssertStringEqual(t, data.RunStatus["CANCELLED"], pipelineRun.Status)
+}
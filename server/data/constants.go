@@ -2,9 +2,50 @@ package data
 
 var (
 	PipelineStatus = map[string]string{
-		"IDLE":     "idle",
-		"RUNNING":  "running",
-		"COMPLETE": "complete",
-		"FAILED":   "failed",
+		"IDLE":      "idle",
+		"RUNNING":   "running",
+		"COMPLETE":  "complete",
+		"FAILED":    "failed",
+		"CANCELLED": "cancelled",
+	}
+
+	// where a stage is in its run, see status.go for how it can move between them
+	StageStatus = map[string]string{
+		"QUEUED":          "queued", // waiting on its dependencies or a free thread
+		"RUNNING":         "running",
+		"SUCCEEDED":       "succeeded",
+		"FAILED":          "failed",
+		"TIMED_OUT":       "timed_out",
+		"CANCELLED":       "cancelled",
+		"SKIPPED":         "skipped", // skipped by config or because a dependency was skipped
+		"UPSTREAM_FAILED": "upstream_failed",
+		"FAILED_ALLOWED":  "failed_allowed", // failed or timed out, but the stage is allowed to fail
+	}
+
+	// where a pipeline run is, see status.go for how it can move between them
+	RunStatus = map[string]string{
+		"QUEUED":    "queued",
+		"RUNNING":   "running",
+		"SUCCEEDED": "succeeded",
+		"FAILED":    "failed",
+		"TIMED_OUT": "timed_out",
+		"CANCELLED": "cancelled",
+	}
+
+	// why a stage (or an attempt at running its task) failed
+	FailureReason = map[string]string{
+		"SPAWN_ERROR":       "spawn_error",
+		"NON_ZERO_EXIT":     "non_zero_exit",
+		"TIMEOUT":           "timeout",
+		"DEPENDENCY_FAILED": "dependency_failed",
+		"CANCELLED":         "cancelled",
+		"CONDITION_ERROR":   "condition_error", // the stage's when condition couldn't be evaluated
+		"VARIABLE_ERROR":    "variable_error",  // an output of another stage the stage uses wasn't published
+		"ARTIFACT_ERROR":    "artifact_error",  // the stage's artifacts couldn't be stored, or the ones it needs restored
+		"PIPELINE_ERROR":    "pipeline_error",  // the pipeline a pipeline stage runs couldn't be started, e.g. it would run itself
+		"PIPELINE_FAILED":   "pipeline_failed", // the run of the pipeline a pipeline stage started didn't succeed
+		"LOCK_ERROR":        "lock_error",      // a lock the stage needs is held by the stage that started its run
+		"LIMIT_EXCEEDED":    "limit_exceeded",  // the task was killed for going over its cpu time or memory limit
+		"AGENT_LOST":        "agent_lost",      // the agent running the task stopped sending heartbeats
 	}
 )
@@ -2,41 +2,226 @@ package data
 
 import "time"
 
-// TODO: should a stage support multiple tasks?
+// RetryPolicy controls if and how a failed stage is run again before it is considered failed
+type RetryPolicy struct {
+	MaxAttempts int    `json:"max_attempts"` // total number of attempts, including the first
+	Backoff     string `json:"backoff"`      // "fixed" (default) or "exponential"
+	Delay       string `json:"delay"`        // wait before the 2nd attempt e.g. "5s", doubles every attempt when exponential
+	MaxDelay    string `json:"max_delay"`    // cap for exponential backoff - optional
+	Jitter      bool   `json:"jitter"`       // randomize each delay between half and all of it
+	ExitCodes   []int  `json:"exit_codes"`   // only retry when the task exits with one of these, any failure is retried when empty
+}
+
+// ProcessLimits are OS limits for the processes a stage runs, a limit that is 0 (or empty) isn't changed
+type ProcessLimits struct {
+	CpuTime        string `json:"cpu_time"`         // cpu time each process can use e.g. "10m", it is killed when it goes over
+	AddressSpaceMB int    `json:"address_space_mb"` // virtual memory each process can map
+	// memory all of the stage's processes can use together, with a cgroup (v2, on Linux). If one can't be
+	// created, each process' address space is limited to it instead
+	MemoryMB  int    `json:"memory_mb"`
+	OpenFiles int    `json:"open_files"`
+	Nice      int    `json:"nice"`     // -20 (highest priority) to 19 (lowest)
+	IOClass   string `json:"io_class"` // "realtime", "best-effort" or "idle"
+	IOLevel   *int   `json:"io_level"` // 0 (highest priority) to 7 within the io class - default 4
+}
+
+// a command run as part of a stage, in the stage's pwd with the stage's env (and its own entries on top)
+type Step struct {
+	Name string   `json:"name"` // shown in the stage log and run record, "step N" if not set
+	Task string   `json:"task"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+}
+
 type Stage struct {
-	Name      string   `json:"name"`
-	Task      string   `json:"task"`
-	Args      []string `json:"args"`
-	DependsOn []string `json:"depends_on"`
-	Pwd       string   `json:"pwd"`
-	Skip      bool     `json:"skip"`
-	Env       []string `json:"env"`
+	Name  string   `json:"name"`
+	Task  string   `json:"task"`
+	Args  []string `json:"args"`
+	Steps []Step   `json:"steps"` // run in order instead of task, the stage fails at the first one that fails
+	// the name of another registered pipeline to run instead of a task, the stage gets the outcome of its run
+	Pipeline  string            `json:"pipeline"`
+	Variables map[string]string `json:"variables"` // set on top of the variables of the pipeline it runs
+	DependsOn []string          `json:"depends_on"`
+	Pwd       string            `json:"pwd"`
+	Skip      bool              `json:"skip"`
+	Env       []string          `json:"env"`
+	Timeout   string            `json:"timeout"` // e.g. "90s" or "1h30m", no limit when empty
+	Retry     *RetryPolicy      `json:"retry"`
+	Shell     string            `json:"shell"`           // run the task string through this shell e.g. "bash", overrides the pipeline's shell
+	QuoteVars *bool             `json:"quote_variables"` // shell quote variables injected into the task when running through a shell, overrides the pipeline's
+	When      string            `json:"when"`            // condition checked just before the stage would run, it is skipped when false
+	RunOn     string            `json:"run_on"`          // "success" (default), "failure" or "always", when to run based on how its dependencies ended
+	// the stage failing (or timing out) doesn't fail the run or stop its dependents, it's counted as a warning instead
+	AllowFailure bool `json:"allow_failure"`
+	// glob patterns (relative to pwd) of the files kept in the run's artifact store after the stage succeeds
+	Artifacts []string `json:"artifacts"`
+	// stages (from depends_on) whose artifacts are copied into pwd before the stage starts
+	NeedsArtifacts []string `json:"needs_artifacts"`
+	// run an instance of the stage for every combination of these values, which are injected as variables
+	Matrix      map[string][]string `json:"matrix"`
+	MaxParallel int                 `json:"max_parallel"` // max instances of a matrix stage running at once, 0 for no limit
+	// named locks held while the stage runs, no two stages (of any run) holding the same lock run at the same time
+	Locks []string `json:"locks"`
+	// how much of each resource the stage needs while it runs e.g. {"cpu": 4, "memory_mb": 8000}
+	Resources map[string]int `json:"resources"`
+	Limits    *ProcessLimits `json:"limits"` // applied to the processes the stage runs
+	// what runs the stage's task: "local" (the default), "dry-run" or the name of one of the pipeline's executors
+	Executor string `json:"executor"`
+	// run the task on an agent (see the agent subcommand) that has all of these labels e.g. ["gpu", "linux"]
+	RunsOn []string `json:"runs_on"`
+	// set on the instances a matrix stage is expanded into when a run starts
+	MatrixOf     string            `json:"-"`
+	MatrixValues map[string]string `json:"-"`
+	// the executor the stage's task runs with, set right before it starts
+	ExecutorConfig Executor `json:"-"`
+}
+
+// an executor the stages of a pipeline can run their tasks with
+type Executor struct {
+	Type string `json:"type"` // "local", "ssh" or "dry-run", stages with runs_on get an "agent" executor
+	// for ssh, the host the tasks run on and how to connect to it
+	Host string `json:"host"`
+	Port int    `json:"port"` // default 22
+	User string `json:"user"` // default the user the server runs as
+	// the private key to authenticate with, otherwise the ssh agent's keys (SSH_AUTH_SOCK) and ~/.ssh/id_* are tried
+	IdentityFile   string `json:"identity_file"`
+	KnownHostsFile string `json:"known_hosts_file"` // to verify the host's key, default ~/.ssh/known_hosts
 }
 
 type Pipeline struct {
-	Name         string  `json:"name"`
-	Stages       []Stage `json:"stages"`
-	Parallel     bool    `json:"parallel"`
-	VariableFile string  `json:"variable_file"`
+	Name         string            `json:"name"`
+	Stages       []Stage           `json:"stages"`
+	Parallel     bool              `json:"parallel"`
+	MaxParallel  int               `json:"max_parallel"` // max stages running at once when parallel, defaults to half the CPUs
+	VariableFile string            `json:"variable_file"`
+	Timeout      string            `json:"timeout"` // limit for the whole run, no limit when empty
+	Shell        string            `json:"shell"`   // default shell for the stages
+	QuoteVars    bool              `json:"quote_variables"`
+	Env          map[string]string `json:"env"`         // env vars for every stage, stage env entries override these
+	InheritEnv   InheritEnv        `json:"inherit_env"` // "all" (default), "none" or a list of env var names
+	// how much of each resource the stages running at once can need in total, resources not listed are unlimited
+	Capacity map[string]int `json:"capacity"`
+	// executors the stages can run their tasks with by name, along with "local" and "dry-run"
+	Executors map[string]Executor `json:"executors"`
+	Executor  string              `json:"executor"` // the default executor of the stages, "local" when empty
+	// the variables injected into the stages when they start, loaded when the definition is validated
+	Variables map[string]string `json:"-"`
+}
+
+// a single run of a stage's task, a stage has more than one when it is retried
+type TaskAttempt struct {
+	Attempt       int       `json:"attempt"`
+	Successful    bool      `json:"successful"`
+	TimedOut      bool      `json:"timedOut"`
+	Cancelled     bool      `json:"cancelled"`
+	ExitCode      int       `json:"exitCode"`                // -1 if the task didn't start or was stopped by a signal
+	Signal        string    `json:"signal,omitempty"`        // the signal that stopped the task, if it was stopped by one
+	FailureReason string    `json:"failureReason,omitempty"` // one of FailureReason, empty if successful
+	Error         string    `json:"error,omitempty"`
+	LogFile       string    `json:"logFile"`
+	StartedAt     time.Time `json:"startedAt"`
+	EndedAt       time.Time `json:"endedAt"`
+	// key=value pairs the task published, through the PIPELINE_OUTPUT file or ::set-output lines on stdout
+	Outputs map[string]string `json:"-"`
+	Steps   []StepResult      `json:"steps,omitempty"` // the steps that ran (or failed to start), for stages with steps
+	// the run of another pipeline this attempt started, for pipeline stages
+	ChildRun *RunLink     `json:"childRun,omitempty"`
+	Limits   *LimitsUsage `json:"limits,omitempty"` // for stages with limits
+	// what the processes of the attempt used, nil if none of them ran
+	Usage *ResourceUsage `json:"usage,omitempty"`
+	Agent string         `json:"agent,omitempty"` // the name of the agent that ran the attempt, for stages with runs_on
+}
+
+// what a task's processes used, from their rusage. Usage of more than one process (or step, or attempt) is added up,
+// except for the max RSS which is the largest of them. Only the cpu times are known on windows.
+type ResourceUsage struct {
+	UserCpuMs   int64 `json:"userCpuMs"`
+	SystemCpuMs int64 `json:"systemCpuMs"`
+	MaxRssKB    int64 `json:"maxRssKb"`    // the most memory a process had in use
+	BlockReads  int64 `json:"blockReads"`  // block input operations
+	BlockWrites int64 `json:"blockWrites"` // block output operations
+	// context switches when waiting for something (like I/O), and when made to give up the cpu
+	VoluntaryContextSwitches   int64 `json:"voluntaryContextSwitches"`
+	InvoluntaryContextSwitches int64 `json:"involuntaryContextSwitches"`
+}
+
+// the limits the processes of an attempt ran with, and the most they used
+type LimitsUsage struct {
+	Limits ProcessLimits `json:"limits"`
+	// the cgroup the processes ran in, empty if the memory limit was applied to each process' address space instead
+	Cgroup       string   `json:"cgroup,omitempty"`
+	PeakMemoryKB int64    `json:"peakMemoryKb"`       // of the cgroup, or the largest max RSS of the processes without one
+	CpuTimeMs    int64    `json:"cpuTimeMs"`          // user and system time of the processes, all together
+	Warnings     []string `json:"warnings,omitempty"` // limits that couldn't be applied
+}
+
+// points to a run of a pipeline, from a run it is linked to
+type RunLink struct {
+	Pipeline string `json:"pipeline"`
+	Id       string `json:"id"`
+	Stage    string `json:"stage,omitempty"` // the stage of the parent run that started it
+}
+
+// the run of a single step of a stage, as part of an attempt
+type StepResult struct {
+	Name      string         `json:"name"`
+	ExitCode  int            `json:"exitCode"` // -1 if the step didn't start or was stopped by a signal
+	Signal    string         `json:"signal,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	StartedAt time.Time      `json:"startedAt"`
+	EndedAt   time.Time      `json:"endedAt"`
+	Usage     *ResourceUsage `json:"usage,omitempty"`
 }
 
 // TODO: do I need to convert these time.Time to int to save?
 type TaskStatusResponse struct {
-	// TODO: instead of bool success, use a status enum for returning to the UI?
-	TaskName   string    `json:"taskName"`
-	Successful bool      `json:"successful"`
-	Skipped    bool      `json:"skipped"`
-	StartedAt  time.Time `json:"startedAt"`
-	EndedAt    time.Time `json:"endedAt"`
+	TaskName  string        `json:"taskName"`
+	Status    string        `json:"status"` // one of StageStatus
+	StartedAt time.Time     `json:"startedAt"`
+	EndedAt   time.Time     `json:"endedAt"`
+	Attempts  []TaskAttempt `json:"attempts"`
+	Env       []string      `json:"env"` // the environment the task ran with, secret values are masked
+	// why the stage was skipped, e.g. the when condition that wasn't met
+	SkipReason string `json:"skipReason,omitempty"`
+	// why the stage failed, taken from its last attempt (or why it never ran)
+	ExitCode      int    `json:"exitCode"`
+	Signal        string `json:"signal,omitempty"`
+	FailureReason string `json:"failureReason,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// outputs published by the last attempt, downstream stages use them as {stages.NAME.KEY}. Secret values are masked
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// the files kept in the run's artifact store, relative to the stage's pwd
+	Artifacts []string `json:"artifacts,omitempty"`
+	// the values an instance of a matrix stage ran with
+	Matrix map[string]string `json:"matrix,omitempty"`
+	// the run of another pipeline started by the last attempt of a pipeline stage
+	ChildRun *RunLink `json:"childRun,omitempty"`
+	// how long the stage was ready to run, but waited for other stages to release its locks
+	LockWaitMs int64 `json:"lockWaitMs,omitempty"`
+	// how long the stage was ready to run, but waited for other stages to free the resources it needs
+	ResourceWaitMs int64 `json:"resourceWaitMs,omitempty"`
+	// what the processes of all of the stage's attempts used
+	Usage *ResourceUsage `json:"usage,omitempty"`
 }
 
 type PipelineRun struct {
-	Name       string               `json:"name"`
-	Stages     []TaskStatusResponse `json:"stages"` // this should probably be a map, instead of array
-	StartedAt  time.Time            `json:"startedAt"`
-	EndedAt    time.Time            `json:"endedAt"`
-	Successful bool                 `json:"successful"`
-	// TODO: should this store a reference the logs for each task?
+	Id          string               `json:"id"`
+	Name        string               `json:"name"`
+	Stages      []TaskStatusResponse `json:"stages"` // this should probably be a map, instead of array
+	StartedAt   time.Time            `json:"startedAt"`
+	EndedAt     time.Time            `json:"endedAt"`
+	MaxParallel int                  `json:"maxParallel"` // the concurrency limit the run actually used
+	Status      string               `json:"status"`      // one of RunStatus
+	Warnings    int                  `json:"warnings"`    // how many stages failed but were allowed to
+	// the run (and its stage) that started this one, when it was run by a pipeline stage
+	ParentRun *RunLink `json:"parentRun,omitempty"`
+}
+
+// a file a stage of a run kept in the artifact store
+type Artifact struct {
+	Stage string `json:"stage"`
+	Path  string `json:"path"` // relative to the stage's pwd, with / separators
+	Size  int64  `json:"size"`
 }
 
 type RegisteredPipeline struct {
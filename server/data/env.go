@@ -0,0 +1,47 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// InheritEnv controls which of the pipeline process's env vars the stages get. In the definition it is either
+// "all" (the default), "none", or a list of the names of the env vars to pass through.
+type InheritEnv []string
+
+func (i *InheritEnv) UnmarshalJSON(b []byte) error {
+	var mode string
+	if err := json.Unmarshal(b, &mode); err == nil {
+		if mode != "all" && mode != "none" && mode != "" {
+			return errors.New("inherit_env must be \"all\", \"none\" or a list of env var names")
+		}
+		*i = InheritEnv{mode}
+		return nil
+	}
+
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return errors.New("inherit_env must be \"all\", \"none\" or a list of env var names")
+	}
+	*i = names
+	return nil
+}
+
+func (i InheritEnv) MarshalJSON() ([]byte, error) {
+	if i.All() {
+		return json.Marshal("all")
+	}
+	if i.None() {
+		return json.Marshal("none")
+	}
+	return json.Marshal([]string(i))
+}
+
+// All is the default, when nothing is set
+func (i InheritEnv) All() bool {
+	return len(i) == 0 || (len(i) == 1 && (i[0] == "all" || i[0] == ""))
+}
+
+func (i InheritEnv) None() bool {
+	return len(i) == 1 && i[0] == "none"
+}
@@ -0,0 +1,49 @@
+package data
+
+import "slices"
+
+// the statuses a stage can move to from each status, anything not listed here is final
+var stageTransitions = map[string][]string{
+	StageStatus["QUEUED"]: {
+		StageStatus["RUNNING"],
+		StageStatus["SKIPPED"],
+		StageStatus["UPSTREAM_FAILED"],
+		StageStatus["CANCELLED"],
+		StageStatus["TIMED_OUT"], // the run timed out before the stage could start
+		StageStatus["FAILED"],    // the stage can never start e.g. unresolvable dependencies
+	},
+	StageStatus["RUNNING"]: {
+		StageStatus["SUCCEEDED"],
+		StageStatus["FAILED"],
+		StageStatus["TIMED_OUT"],
+		StageStatus["CANCELLED"],
+		StageStatus["FAILED_ALLOWED"],
+	},
+}
+
+// the statuses a run can move to from each status, anything not listed here is final
+var runTransitions = map[string][]string{
+	RunStatus["QUEUED"]: {
+		RunStatus["RUNNING"],
+		RunStatus["CANCELLED"],
+	},
+	RunStatus["RUNNING"]: {
+		RunStatus["SUCCEEDED"],
+		RunStatus["FAILED"],
+		RunStatus["TIMED_OUT"],
+		RunStatus["CANCELLED"],
+	},
+}
+
+func CanTransitionStage(from string, to string) bool {
+	return slices.Contains(stageTransitions[from], to)
+}
+
+func CanTransitionRun(from string, to string) bool {
+	return slices.Contains(runTransitions[from], to)
+}
+
+// a stage that ended up succeeded, skipped or failed when it's allowed to doesn't fail the run or its dependents
+func StageStatusSuccessful(status string) bool {
+	return status == StageStatus["SUCCEEDED"] || status == StageStatus["SKIPPED"] || status == StageStatus["FAILED_ALLOWED"]
+}
@@ -1,9 +1,16 @@
 package data
 
+import "time"
+
 type ApiErrorResponse struct {
 	Message string `json:"msg"`
 }
 
+type LaunchPipelineResponse struct {
+	Message string `json:"msg"`
+	RunId   string `json:"run_id,omitempty"` // only set when the run was started
+}
+
 type RegisterFilePath struct {
 	DefinitionFilePath string `json:"filepath"`
 	VariableFilePath   string `json:"variable_file"`
@@ -21,19 +28,83 @@ type RegisteredPipelineResponse struct {
 }
 
 type RegisteredPipelineDetails struct {
-	Name      string            `json:"name"`
-	Stages    []Stage           `json:"stages"`
-	Parallel  bool              `json:"parallel"`
-	Variables map[string]string `json:"variables"`
-	LastRun   int64             `json:"last_run"` // the last time the pipeline was run
-	Status    string            `json:"status"`   // the current status of the pipeline
+	Name        string              `json:"name"`
+	Stages      []Stage             `json:"stages"`
+	Parallel    bool                `json:"parallel"`
+	MaxParallel int                 `json:"max_parallel"`
+	Timeout     string              `json:"timeout"`
+	Shell       string              `json:"shell"`
+	QuoteVars   bool                `json:"quote_variables"`
+	Env         map[string]string   `json:"env"`
+	InheritEnv  InheritEnv          `json:"inherit_env"`
+	Capacity    map[string]int      `json:"capacity"`
+	Executors   map[string]Executor `json:"executors"`
+	Executor    string              `json:"executor"`
+	Variables   map[string]string   `json:"variables"`
+	LastRun     int64               `json:"last_run"` // the last time the pipeline was run
+	Status      string              `json:"status"`   // the current status of the pipeline
 	// TODO: should I add a list of run here?
 	// TODO: add last run logs
 }
 
 type EditPipelineRequest struct {
-	Name      string            `json:"name"`
-	Stages    []Stage           `json:"stages"`
-	Parallel  bool              `json:"parallel"`
-	Variables map[string]string `json:"variables"`
+	Name        string              `json:"name"`
+	Stages      []Stage             `json:"stages"`
+	Parallel    bool                `json:"parallel"`
+	MaxParallel int                 `json:"max_parallel"`
+	Timeout     string              `json:"timeout"`
+	Shell       string              `json:"shell"`
+	QuoteVars   bool                `json:"quote_variables"`
+	Env         map[string]string   `json:"env"`
+	InheritEnv  InheritEnv          `json:"inherit_env"`
+	Capacity    map[string]int      `json:"capacity"`
+	Executors   map[string]Executor `json:"executors"`
+	Executor    string              `json:"executor"`
+	Variables   map[string]string   `json:"variables"`
+}
+
+// sent by an agent when it starts, to be given jobs for the stages that run on its labels
+type AgentRegistration struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+type AgentRegistered struct {
+	Id string `json:"id"` // identifies the agent in the rest of its requests
+	// how often the agent has to send a heartbeat, it is considered gone after missing a few
+	HeartbeatIntervalMs int64 `json:"heartbeatIntervalMs"`
+}
+
+// the jobs an agent is running that it has to stop, in answer to its heartbeat
+type AgentHeartbeatResponse struct {
+	Terminate []string `json:"terminate,omitempty"`
+	Kill      []string `json:"kill,omitempty"`
+}
+
+// a command of a stage (its task, or one of its steps) for an agent to run
+type AgentJob struct {
+	Id       string   `json:"id"`
+	Pipeline string   `json:"pipeline"`
+	Stage    string   `json:"stage"`
+	Task     string   `json:"task"`
+	Args     []string `json:"args"`
+	Shell    string   `json:"shell"`
+	Pwd      string   `json:"pwd"`
+	Env      []string `json:"env"` // the pipeline's and the stage's, the agent's own env is inherited
+}
+
+// how the command of a job exited, sent by the agent once it has sent all of its output
+type AgentJobExit struct {
+	ExitCode int            `json:"exitCode"`
+	Signal   string         `json:"signal,omitempty"`
+	Error    string         `json:"error,omitempty"` // empty if it exited with 0
+	Usage    *ResourceUsage `json:"usage,omitempty"`
+}
+
+type AgentResponse struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Labels   []string  `json:"labels"`
+	LastSeen time.Time `json:"lastSeen"`
+	Jobs     []string  `json:"jobs"` // the stages it's running, as "pipeline/stage"
 }
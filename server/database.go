@@ -5,10 +5,12 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"pipeline/data"
 	"pipeline/utils"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +21,7 @@ import (
 
 const PIPELINE_RUNS = "pipeline_runs"
 const REGISTERED_PIPELINES_FILE = "registered_pipelines.json"
+const ARTIFACTS = "artifacts"
 
 func loadRegisteredPipelines(logger *logrus.Logger) map[string]data.RegisteredPipeline {
 	utils.InitDataStoreDir(logger)
@@ -83,10 +86,8 @@ func (a ByDateString) Less(i, j int) bool {
 	}
 
 	// parsing this for every comparison seems wild
-	var iPureName = strings.Split(a[i].Name(), ".")[0]
-	var jPureName = strings.Split(a[j].Name(), ".")[0]
-	var iTime, iErr = time.Parse(time.DateTime, strings.Replace(iPureName, "_", ":", 2))
-	var jTime, jErr = time.Parse(time.DateTime, strings.Replace(jPureName, "_", ":", 2))
+	var iTime, iErr = runFileTime(a[i].Name())
+	var jTime, jErr = runFileTime(a[j].Name())
 
 	if iErr != nil || jErr != nil {
 		return false
@@ -94,6 +95,15 @@ func (a ByDateString) Less(i, j int) bool {
 	return iTime.Before(jTime)
 }
 
+// run files are named after when they were saved, followed by the run id (older ones only have the time)
+func runFileTime(filename string) (time.Time, error) {
+	var pureName = strings.Split(filename, ".")[0]
+	if len(pureName) > len(time.DateTime) {
+		pureName = pureName[:len(time.DateTime)]
+	}
+	return time.Parse(time.DateTime, strings.Replace(pureName, "_", ":", 2))
+}
+
 func loadPipelineRuns(logger *logrus.Logger, pipelineName string, limit int) []data.PipelineRun {
 	utils.InitDataStoreDir(logger)
 
@@ -141,6 +151,17 @@ func loadPipelineRuns(logger *logrus.Logger, pipelineName string, limit int) []d
 				continue
 			}
 
+			// runs saved before statuses were added only have the old flags, upgrade the file the first time it's read
+			if pipelineRun.Status == "" {
+				if !migratePipelineRun(fileData, &pipelineRun) {
+					logger.Error("Unable to migrate pipeline run file: " + filename)
+					continue
+				}
+				if writePipelineRun(filename, pipelineRun, logger) {
+					logger.Info("Migrated pipeline run file: " + filename)
+				}
+			}
+
 			pipelineRuns = append(pipelineRuns, pipelineRun)
 		}
 	}
@@ -156,9 +177,13 @@ func savePipelineRun(pipelineRun data.PipelineRun, logger *logrus.Logger) bool {
 		return false
 	}
 
-	var filename = path.Join(os.Getenv("DATA_STORE_DIR"), PIPELINE_RUNS, pipelineRun.Name, utils.GetCurrentTimeStamp(true)+".json")
+	// runs of the same pipeline can end within the same second, e.g. when started by pipeline stages
+	var filename = path.Join(os.Getenv("DATA_STORE_DIR"), PIPELINE_RUNS, pipelineRun.Name, utils.GetCurrentTimeStamp(true)+" "+pipelineRun.Id+".json")
+	return writePipelineRun(filename, pipelineRun, logger)
+}
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+func writePipelineRun(filename string, pipelineRun data.PipelineRun, logger *logrus.Logger) bool {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		logger.Error("Error creating pipeline run file: " + err.Error())
 		return false
@@ -178,3 +203,189 @@ func savePipelineRun(pipelineRun data.PipelineRun, logger *logrus.Logger) bool {
 
 	return true
 }
+
+// the flags runs and their stages were saved with before they had a status
+type legacyPipelineRun struct {
+	Successful bool `json:"successful"`
+	TimedOut   bool `json:"timedOut"`
+	Cancelled  bool `json:"cancelled"`
+	Stages     []struct {
+		Successful bool `json:"successful"`
+		Skipped    bool `json:"skipped"`
+		TimedOut   bool `json:"timedOut"`
+		Cancelled  bool `json:"cancelled"`
+	} `json:"stages"`
+}
+
+// migratePipelineRun works out the statuses of a run saved before they existed, from the flags it was saved with.
+// A stage skipped without succeeding could also have been skipped because the run timed out, but the old flags
+// can't tell these apart, so it's treated as a failed dependency.
+func migratePipelineRun(fileData []byte, pipelineRun *data.PipelineRun) bool {
+	var legacy legacyPipelineRun
+	if err := json.Unmarshal(fileData, &legacy); err != nil || len(legacy.Stages) != len(pipelineRun.Stages) {
+		return false
+	}
+
+	for i, stage := range legacy.Stages {
+		switch {
+		case stage.Cancelled:
+			pipelineRun.Stages[i].Status = data.StageStatus["CANCELLED"]
+		case stage.Skipped && stage.Successful:
+			pipelineRun.Stages[i].Status = data.StageStatus["SKIPPED"]
+		case stage.Skipped:
+			pipelineRun.Stages[i].Status = data.StageStatus["UPSTREAM_FAILED"]
+		case stage.TimedOut:
+			pipelineRun.Stages[i].Status = data.StageStatus["TIMED_OUT"]
+		case stage.Successful:
+			pipelineRun.Stages[i].Status = data.StageStatus["SUCCEEDED"]
+		default:
+			pipelineRun.Stages[i].Status = data.StageStatus["FAILED"]
+		}
+	}
+
+	switch {
+	case legacy.Cancelled:
+		pipelineRun.Status = data.RunStatus["CANCELLED"]
+	case legacy.TimedOut:
+		pipelineRun.Status = data.RunStatus["TIMED_OUT"]
+	case legacy.Successful:
+		pipelineRun.Status = data.RunStatus["SUCCEEDED"]
+	default:
+		pipelineRun.Status = data.RunStatus["FAILED"]
+	}
+
+	return true
+}
+
+// artifactsDir is where the artifacts of a run are kept, in a directory per stage
+func artifactsDir(pipelineName string, runId string) string {
+	return filepath.Join(os.Getenv("DATA_STORE_DIR"), ARTIFACTS, pipelineName, runId)
+}
+
+// saveArtifacts copies the files matching the stage's artifacts patterns into the run's artifact store, a directory
+// that matches is copied with everything in it. Returns the files kept, relative to the stage's pwd.
+func saveArtifacts(pipelineName string, runId string, stage data.Stage, logger *logrus.Logger) ([]string, error) {
+	var stageDir = filepath.Join(artifactsDir(pipelineName, runId), stage.Name)
+	var workDir = stage.Pwd
+	if workDir == "" {
+		workDir = "."
+	}
+
+	var artifacts []string
+	for _, pattern := range stage.Artifacts {
+		matches, err := filepath.Glob(filepath.Join(workDir, pattern))
+		if err != nil {
+			return artifacts, err
+		}
+		if len(matches) == 0 {
+			logger.Warn("No files matched artifacts pattern '" + pattern + "' of stage: " + stage.Name)
+		}
+
+		for _, match := range matches {
+			err = filepath.WalkDir(match, func(file string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+
+				relative, err := filepath.Rel(workDir, file)
+				if err != nil {
+					return err
+				}
+				relative = filepath.ToSlash(relative)
+				if slices.Contains(artifacts, relative) {
+					return nil // matched by more than one pattern
+				}
+
+				if err = utils.CopyFile(file, filepath.Join(stageDir, relative)); err != nil {
+					return err
+				}
+				artifacts = append(artifacts, relative)
+				return nil
+			})
+			if err != nil {
+				return artifacts, err
+			}
+		}
+	}
+
+	logger.Info("Stored " + strconv.Itoa(len(artifacts)) + " artifacts of stage: " + stage.Name)
+	return artifacts, nil
+}
+
+// restoreArtifacts copies the artifacts of the stages the stage needs into its pwd, at the same paths they
+// had in the pwd of the stage that made them
+func restoreArtifacts(pipelineName string, runId string, stage data.Stage, logger *logrus.Logger) error {
+	var workDir = stage.Pwd
+	if workDir == "" {
+		workDir = "."
+	}
+
+	for _, dependency := range stage.NeedsArtifacts {
+		var stageDir = filepath.Join(artifactsDir(pipelineName, runId), dependency)
+		if _, err := os.Stat(stageDir); os.IsNotExist(err) {
+			logger.Warn("No artifacts of stage: " + dependency + " to restore for stage: " + stage.Name)
+			continue
+		}
+
+		err := filepath.WalkDir(stageDir, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+
+			relative, err := filepath.Rel(stageDir, file)
+			if err != nil {
+				return err
+			}
+			return utils.CopyFile(file, filepath.Join(workDir, relative))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadArtifacts lists the artifacts kept for a run, by stage
+func loadArtifacts(pipelineName string, runId string, logger *logrus.Logger) []data.Artifact {
+	var runDir = artifactsDir(pipelineName, runId)
+	var artifacts = []data.Artifact{}
+
+	entries, err := os.ReadDir(runDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error reading " + runDir + " directory: " + err.Error())
+		}
+		return artifacts
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		var stageDir = filepath.Join(runDir, entry.Name())
+		err = filepath.WalkDir(stageDir, func(file string, fileEntry fs.DirEntry, err error) error {
+			if err != nil || fileEntry.IsDir() {
+				return err
+			}
+
+			info, err := fileEntry.Info()
+			if err != nil {
+				return err
+			}
+			relative, err := filepath.Rel(stageDir, file)
+			if err != nil {
+				return err
+			}
+
+			artifacts = append(artifacts, data.Artifact{Stage: entry.Name(), Path: filepath.ToSlash(relative), Size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			logger.Error("Error reading artifacts of stage " + entry.Name() + ": " + err.Error())
+		}
+	}
+
+	return artifacts
+}
@@ -117,3 +117,39 @@ func Test_loadPipelineRuns_ShouldReturnAllExistingPipelineRunsInOrderOfDateWhenL
 		os.Remove(filename)
 	}
 }
+
+func Test_loadPipelineRuns_ShouldMigrateRunsSavedBeforeStatuses(t *testing.T) {
+	// arrange
+	var pipelineRunPath = path.Join(os.Getenv("DATA_STORE_DIR"), "pipeline_runs/test_pipeline_legacy")
+	utils.InitDir(pipelineRunPath, testLogger)
+
+	var filename = path.Join(pipelineRunPath, "2023-03-01 02_00_00.json")
+	os.WriteFile(filename, []byte(`{"id":"legacy","name":"test_pipeline_legacy","successful":false,"stages":[
+		{"taskName":"build","successful":true,"skipped":false},
+		{"taskName":"lint","successful":true,"skipped":true},
+		{"taskName":"test","successful":false,"skipped":false,"timedOut":true},
+		{"taskName":"deploy","successful":false,"skipped":true}
+	]}`), 0644)
+
+	// act
+	var pipelineRuns = loadPipelineRuns(testLogger, "test_pipeline_legacy", -1)
+	var fileData, _ = os.ReadFile(filename)
+
+	// assert
+	utils.AssertEqual(t, 1, len(pipelineRuns))
+	utils.AssertStringEqual(t, data.RunStatus["FAILED"], pipelineRuns[0].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], pipelineRuns[0].Stages[0].Status)
+	utils.AssertStringEqual(t, data.StageStatus["SKIPPED"], pipelineRuns[0].Stages[1].Status)
+	utils.AssertStringEqual(t, data.StageStatus["TIMED_OUT"], pipelineRuns[0].Stages[2].Status)
+	utils.AssertStringEqual(t, data.StageStatus["UPSTREAM_FAILED"], pipelineRuns[0].Stages[3].Status)
+
+	// the file is rewritten with the statuses, without the old flags
+	var migrated map[string]any
+	json.Unmarshal(fileData, &migrated)
+	utils.AssertStringEqual(t, data.RunStatus["FAILED"], migrated["status"].(string))
+	_, hasOldFlag := migrated["successful"]
+	utils.AssertFalse(t, hasOldFlag)
+
+	// cleanup
+	os.Remove(filename)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"pipeline/data"
+	"strings"
+)
+
+// an executor runs the commands of stages' tasks (or each of their steps). A stage picks one with its executor field,
+// whichever it is the command's output, exit code and signal come back the same way.
+type executor interface {
+	// start starts a stage's task with env, in the stage's pwd
+	start(stage data.Stage, env []string) (process, error)
+}
+
+// a command started by an executor
+type process interface {
+	stdout() io.Reader
+	stderr() io.Reader
+	terminate() error // ask the command, and anything it started, to stop
+	kill() error      // forcefully stop the command, and anything it started
+	// wait waits for the command to exit, once its stdout and stderr have been read
+	wait() processExit
+}
+
+// how a command exited
+type processExit struct {
+	exitCode int    // -1 if it was stopped by a signal
+	signal   string // the signal that stopped it, if any
+	usage    *data.ResourceUsage
+	err      error // nil if it exited with 0
+	// why the task failed when it isn't the exit code e.g. the agent running it was lost, empty otherwise
+	failureReason string
+	agent         string // the name of the agent that ran it, for stages with runs_on
+}
+
+// newExecutor creates the executor of a stage's task, limits (if any) are applied by the local one
+func newExecutor(config data.Executor, pipelineName string, limits *stageLimits) executor {
+	switch config.Type {
+	case "ssh":
+		return sshExecutor{config: config}
+	case "agent":
+		return agentExecutor{pipelineName: pipelineName}
+	case "dry-run":
+		return dryRunExecutor{}
+	default:
+		return localExecutor{limits: limits}
+	}
+}
+
+// runs tasks as processes of the server
+type localExecutor struct {
+	limits *stageLimits
+}
+
+type localProcess struct {
+	cmd        *exec.Cmd
+	stdoutPipe io.Reader
+	stderrPipe io.Reader
+}
+
+func (e localExecutor) start(stage data.Stage, env []string) (process, error) {
+	cmd := buildCommand(stage)
+	cmd.Dir = stage.Pwd
+	cmd.Env = env
+	setProcessGroup(cmd)
+
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if e.limits != nil {
+		e.limits.prepare(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		if e.limits != nil {
+			e.limits.abandon()
+		}
+		return nil, err
+	}
+	if e.limits != nil {
+		e.limits.apply(cmd.Process.Pid)
+	}
+	return &localProcess{cmd: cmd, stdoutPipe: stdoutPipe, stderrPipe: stderrPipe}, nil
+}
+
+func (p *localProcess) stdout() io.Reader { return p.stdoutPipe }
+func (p *localProcess) stderr() io.Reader { return p.stderrPipe }
+func (p *localProcess) terminate() error  { return terminateProcessGroup(p.cmd) }
+func (p *localProcess) kill() error       { return killProcessGroup(p.cmd) }
+
+func (p *localProcess) wait() processExit {
+	err := p.cmd.Wait()
+	var usage = processUsage(p.cmd.ProcessState)
+	return processExit{exitCode: p.cmd.ProcessState.ExitCode(), signal: exitSignal(p.cmd.ProcessState), usage: &usage, err: err}
+}
+
+// doesn't run anything, only logs the command each task would run, as if it succeeded
+type dryRunExecutor struct{}
+
+type dryRunProcess struct {
+	output io.Reader
+}
+
+func (e dryRunExecutor) start(stage data.Stage, env []string) (process, error) {
+	var output = "dry run, would run: " + buildCommand(stage).String() + "\n"
+	if stage.Pwd != "" {
+		output += "in: " + stage.Pwd + "\n"
+	}
+	return &dryRunProcess{output: strings.NewReader(output)}, nil
+}
+
+func (p *dryRunProcess) stdout() io.Reader { return p.output }
+func (p *dryRunProcess) stderr() io.Reader { return strings.NewReader("") }
+func (p *dryRunProcess) terminate() error  { return nil }
+func (p *dryRunProcess) kill() error       { return nil }
+func (p *dryRunProcess) wait() processExit { return processExit{} }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"pipeline/data"
+	"pipeline/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// how long connecting (and authenticating) to an ssh executor's host can take
+const SSH_CONNECT_TIMEOUT = 30 * time.Second
+
+var envNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// runs tasks on another host over ssh, through sh. Each command gets its own connection, and is stopped through its
+// stdin rather than ssh signals (which many sshd builds ignore): a terminate line asks it to stop, and the stdin
+// closing (the command being killed, or the connection being lost) kills it and anything it started
+type sshExecutor struct {
+	config data.Executor
+}
+
+type sshProcess struct {
+	client     *ssh.Client
+	session    *ssh.Session
+	agent      net.Conn // the connection to the ssh agent, nil when it isn't used
+	stdinPipe  io.WriteCloser
+	stdoutPipe io.Reader
+	stderrPipe io.Reader
+}
+
+func (e sshExecutor) start(stage data.Stage, env []string) (process, error) {
+	auth, agentConn, err := sshAuth(e.config)
+	if err != nil {
+		return nil, err
+	}
+	var process = &sshProcess{agent: agentConn}
+
+	hostKeys, err := sshKnownHosts(e.config)
+	if err != nil {
+		process.close()
+		return nil, err
+	}
+
+	var port = e.config.Port
+	if port == 0 {
+		port = 22
+	}
+	process.client, err = ssh.Dial("tcp", net.JoinHostPort(e.config.Host, strconv.Itoa(port)), &ssh.ClientConfig{
+		User: sshUser(e.config), Auth: auth, HostKeyCallback: hostKeys, Timeout: SSH_CONNECT_TIMEOUT,
+	})
+	if err != nil {
+		process.close()
+		return nil, err
+	}
+
+	process.session, err = process.client.NewSession()
+	if err == nil {
+		process.stdinPipe, err = process.session.StdinPipe()
+	}
+	if err == nil {
+		process.stdoutPipe, err = process.session.StdoutPipe()
+	}
+	if err == nil {
+		process.stderrPipe, err = process.session.StderrPipe()
+	}
+	if err == nil {
+		err = process.session.Start(remoteCommand(stage, env))
+	}
+	if err != nil {
+		process.close()
+		return nil, err
+	}
+	return process, nil
+}
+
+func (p *sshProcess) stdout() io.Reader { return p.stdoutPipe }
+func (p *sshProcess) stderr() io.Reader { return p.stderrPipe }
+func (p *sshProcess) kill() error       { return p.client.Close() }
+
+func (p *sshProcess) terminate() error {
+	_, err := io.WriteString(p.stdinPipe, "terminate\n")
+	return err
+}
+
+func (p *sshProcess) wait() processExit {
+	err := p.session.Wait()
+	p.close()
+
+	var exitError *ssh.ExitError
+	if err == nil {
+		return processExit{}
+	}
+	if errors.As(err, &exitError) {
+		if exitError.Signal() != "" {
+			var signal = "SIG" + exitError.Signal()
+			return processExit{exitCode: -1, signal: signal, err: errors.New("signal: " + signal)}
+		}
+		return processExit{exitCode: exitError.ExitStatus(), err: errors.New("exit status " + strconv.Itoa(exitError.ExitStatus()))}
+	}
+	// the connection was closed (or lost) before the command exited
+	return processExit{exitCode: -1, err: err}
+}
+
+func (p *sshProcess) close() {
+	if p.client != nil {
+		p.client.Close()
+	}
+	if p.agent != nil {
+		p.agent.Close()
+	}
+}
+
+// remoteCommand builds the command that runs a stage's task on the remote host: with its env exported, in its pwd,
+// and the outputs it writes to the file in PIPELINE_OUTPUT printed as ::set-output lines once it exits. It's run
+// through sh, whatever the user's login shell is.
+//
+// The task runs in the background while sh watches its stdin: a terminate line sends SIGTERM to the session sshd
+// started it in (sh itself ignores it), and the stdin closing kills the whole session. When the task is killed by a
+// signal, sh kills itself with the same one so sshd reports it.
+func remoteCommand(stage data.Stage, env []string) string {
+	var script strings.Builder
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		// the host has its own output file, and sh can't set names that aren't valid variable names
+		if key == "PIPELINE_OUTPUT" || !envNameRegex.MatchString(key) {
+			continue
+		}
+		script.WriteString("export " + key + "=" + utils.ShellQuote("sh", value) + "\n")
+	}
+	if stage.Pwd != "" {
+		script.WriteString("cd " + utils.ShellQuote("sh", stage.Pwd) + " || exit 1\n")
+	}
+	script.WriteString("PIPELINE_OUTPUT=$(mktemp) || exit 1\nexport PIPELINE_OUTPUT\n")
+
+	var args []string
+	for _, arg := range buildCommand(stage).Args {
+		args = append(args, utils.ShellQuote("sh", arg))
+	}
+	script.WriteString("exec 3<&0\n")
+	script.WriteString(strings.Join(args, " ") + " </dev/null &\n")
+	script.WriteString("pid=$!\n")
+	script.WriteString("trap '' TERM\n")
+	// the watcher, which only stops the task itself when sh doesn't lead its session
+	script.WriteString("(\n")
+	script.WriteString("\twhile read -r request <&3; do\n")
+	script.WriteString("\t\tif [ \"$request\" = terminate ]; then kill -TERM -$$ 2>/dev/null || kill -TERM $pid; fi\n")
+	script.WriteString("\tdone\n")
+	script.WriteString("\tkill -KILL -$$ 2>/dev/null || kill -KILL $pid $$\n")
+	script.WriteString(") &\n")
+	script.WriteString("watcher=$!\n")
+	script.WriteString("wait $pid 2>/dev/null\n")
+	script.WriteString("status=$?\n")
+	script.WriteString("{ kill -KILL $watcher; wait $watcher; } 2>/dev/null\n")
+
+	script.WriteString("sed 's/^/" + OUTPUT_MARKER + "/' \"$PIPELINE_OUTPUT\"\n")
+	script.WriteString("rm -f \"$PIPELINE_OUTPUT\"\n")
+	script.WriteString("if [ $status -gt 128 ] && [ $status -lt 160 ]; then trap - TERM; kill -$((status - 128)) $$; fi\n")
+	script.WriteString("exit $status\n")
+	// exec so sh is the process sshd started, the leader of its session
+	return "exec sh -c " + utils.ShellQuote("sh", script.String())
+}
+
+// sshUser is the user to connect as, the one the server runs as by default
+func sshUser(config data.Executor) string {
+	if config.User != "" {
+		return config.User
+	}
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	// windows user names include the domain e.g. DOMAIN\name
+	return current.Username[strings.LastIndex(current.Username, "\\")+1:]
+}
+
+// sshAuth returns the ways to authenticate to an ssh executor's host: the identity file when it's set, otherwise
+// the keys of the ssh agent and the default keys in ~/.ssh. The agent's connection (if any) has to be closed after.
+func sshAuth(config data.Executor) ([]ssh.AuthMethod, net.Conn, error) {
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	var keyFiles = []string{config.IdentityFile}
+	if config.IdentityFile == "" {
+		if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+			if conn, err := net.Dial("unix", socket); err == nil {
+				agentConn = conn
+				methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+
+		home, _ := os.UserHomeDir()
+		keyFiles = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_ecdsa"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		key, err := os.ReadFile(keyFile)
+		if err == nil {
+			var signer ssh.Signer
+			if signer, err = ssh.ParsePrivateKey(key); err == nil {
+				signers = append(signers, signer)
+				continue
+			}
+		}
+		// the default keys are only tried if they're there, and usable without a passphrase
+		if config.IdentityFile != "" {
+			return nil, nil, errors.New("unable to use identity_file (keys with a passphrase can only be used through the ssh agent): " + err.Error())
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no keys to authenticate to " + config.Host + " with, set identity_file or run an ssh agent")
+	}
+	return methods, agentConn, nil
+}
+
+// sshKnownHosts verifies the host's key is in the known hosts file, connecting to a host that isn't is refused
+func sshKnownHosts(config data.Executor) (ssh.HostKeyCallback, error) {
+	var file = config.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(file)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pipeline/data"
+	"pipeline/utils"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testSSHPipeline = "test_assets/test_pipeline_ssh_linux.json"
+
+// sshServerHelper starts an ssh server that runs commands with sh, like sshd would. It only accepts the key in the
+// identity file it returns, and its host key is the one in the known hosts file it returns
+func sshServerHelper(t *testing.T) (int, string, string) {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	clientPublicKey, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSSHKey, _ := ssh.NewPublicKey(clientPublicKey)
+
+	var config = &ssh.ServerConfig{PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if bytes.Equal(key.Marshal(), clientSSHKey.Marshal()) {
+			return nil, nil
+		}
+		return nil, errors.New("unknown key")
+	}}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertTrue(t, err == nil)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConnection(conn, config)
+		}
+	}()
+
+	var dir = t.TempDir()
+	var identityFile = filepath.Join(dir, "id_ed25519")
+	pemBlock, _ := ssh.MarshalPrivateKey(clientKey, "")
+	os.WriteFile(identityFile, pem.EncodeToMemory(pemBlock), 0600)
+	var knownHostsFile = filepath.Join(dir, "known_hosts")
+	os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())+"\n"), 0600)
+
+	return listener.Addr().(*net.TCPAddr).Port, identityFile, knownHostsFile
+}
+
+func serveSSHConnection(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHSession(channel, channelRequests)
+	}
+}
+
+// runs the command of a session, and sends back how it exited. It's stopped when the session is closed
+func serveSSHSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var cmd *exec.Cmd
+	var exited chan struct{}
+	for {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				if cmd != nil {
+					killProcessGroup(cmd)
+				}
+				return
+			}
+
+			switch request.Type {
+			case "exec":
+				var payload struct{ Command string }
+				ssh.Unmarshal(request.Payload, &payload)
+				cmd = exec.Command("sh", "-c", payload.Command)
+				cmd.Stdout, cmd.Stderr = channel, channel.Stderr()
+				// sshd starts it in its own session, with a pipe it closes once the client closes its stdin
+				setProcessGroup(cmd)
+				stdin, _ := cmd.StdinPipe()
+				if err := cmd.Start(); err != nil {
+					request.Reply(false, nil)
+					return
+				}
+				request.Reply(true, nil)
+				go func() {
+					io.Copy(stdin, channel)
+					stdin.Close()
+				}()
+				exited = make(chan struct{})
+				go func() {
+					cmd.Wait()
+					close(exited)
+				}()
+			default:
+				request.Reply(false, nil)
+			}
+		case <-exited:
+			if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: strings.TrimPrefix(exitSignal(cmd.ProcessState), "SIG")}))
+			} else {
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(cmd.ProcessState.ExitCode())}))
+			}
+			return
+		}
+	}
+}
+
+func Test_runPipeline_ShouldRunStagesWithSSHExecutorsOnTheirHost(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test ssh server runs commands with sh")
+	}
+	t.Parallel()
+
+	// arrange
+	var port, identityFile, knownHostsFile = sshServerHelper(t)
+	var pipeline data.Pipeline = pipelineLoadHelper(testSSHPipeline)
+	pipeline.Executors["nas"] = data.Executor{Type: "ssh", Host: "127.0.0.1", Port: port, IdentityFile: identityFile, KnownHostsFile: knownHostsFile}
+	// the host isn't in its known hosts file
+	var emptyKnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(emptyKnownHosts, nil, 0600)
+	pipeline.Executors["stranger"] = data.Executor{Type: "ssh", Host: "127.0.0.1", Port: port, IdentityFile: identityFile, KnownHostsFile: emptyKnownHosts}
+	var pwd = t.TempDir()
+	pipeline.Stages[0].Pwd = pwd
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	var taskMap map[string]data.TaskStatusResponse = make(map[string]data.TaskStatusResponse)
+	for _, task := range pipelineRun.Stages {
+		taskMap[task.TaskName] = task
+	}
+
+	// assert
+	utils.AssertFalse(t, success)
+
+	// the output, env, pwd and outputs of the task come back like they do for a local one
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["remote"].Status)
+	utils.AssertStringEqual(t, "yes", taskMap["remote"].Outputs["built"])
+	var logData, _ = os.ReadFile(taskMap["remote"].Attempts[0].LogFile)
+	utils.AssertTrue(t, strings.Contains(string(logData), "mode=fast in "+pwd+"\n"))
+	utils.AssertTrue(t, strings.Contains(string(logData), "oops\n"))
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["uses_output"].Status)
+	logData, _ = os.ReadFile(taskMap["uses_output"].Attempts[0].LogFile)
+	utils.AssertStringEqual(t, "got yes\n", string(logData))
+
+	utils.AssertStringEqual(t, data.FailureReason["NON_ZERO_EXIT"], taskMap["exit_code"].FailureReason)
+	utils.AssertEqual(t, 3, taskMap["exit_code"].ExitCode)
+	utils.AssertStringEqual(t, "exit status 3", taskMap["exit_code"].Error)
+
+	// the command is stopped on the host when the stage times out
+	utils.AssertStringEqual(t, data.StageStatus["TIMED_OUT"], taskMap["times_out"].Status)
+	utils.AssertStringEqual(t, "SIGTERM", taskMap["times_out"].Signal)
+	utils.AssertTrue(t, taskMap["times_out"].EndedAt.Sub(taskMap["times_out"].StartedAt) < TERMINATE_GRACE_PERIOD)
+
+	utils.AssertStringEqual(t, data.FailureReason["SPAWN_ERROR"], taskMap["unknown_host"].FailureReason)
+	utils.AssertTrue(t, strings.Contains(taskMap["unknown_host"].Error, "knownhosts: key is unknown"))
+
+	utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], taskMap["local"].Status)
+
+	// TODO: cleanup
+}
+
+func Test_sshExecutor_ShouldKeepStderrSeparateAndLetTheCommandCleanUpWhenTerminated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test ssh server runs commands with sh")
+	}
+	t.Parallel()
+
+	// arrange
+	var port, identityFile, knownHostsFile = sshServerHelper(t)
+	var executor = sshExecutor{config: data.Executor{Type: "ssh", Host: "127.0.0.1", Port: port, IdentityFile: identityFile, KnownHostsFile: knownHostsFile}}
+	var stage = data.Stage{Name: "cleans_up", Shell: "sh", Task: "trap 'echo cleaning up; exit 7' TERM; echo oops >&2; echo started; sleep 30 & wait"}
+	process, err := executor.start(stage, nil)
+	utils.AssertTrue(t, err == nil)
+	var stderr bytes.Buffer
+	var stderrDone = make(chan struct{})
+	go func() {
+		io.Copy(&stderr, process.stderr())
+		close(stderrDone)
+	}()
+	var stdout = bufio.NewReader(process.stdout())
+	started, _ := stdout.ReadString('\n')
+
+	// act
+	process.terminate()
+	rest, _ := io.ReadAll(stdout)
+	<-stderrDone
+	var exit = process.wait()
+
+	// assert
+	utils.AssertStringEqual(t, "started\n", started)
+	utils.AssertStringEqual(t, "cleaning up\n", string(rest))
+	utils.AssertStringEqual(t, "oops\n", stderr.String())
+	utils.AssertEqual(t, 7, exit.exitCode)
+
+	// TODO: cleanup
+}
+
+func Test_runPipeline_ShouldOnlyLogTheCommandsOfStagesWithTheDryRunExecutor(t *testing.T) {
+	t.Parallel()
+
+	// arrange
+	var pipeline data.Pipeline = pipelineLoadHelper(testFailurePipeline)
+	pipeline.Executor = "dry-run"
+
+	// act
+	var success, pipelineRun = runPipeline(context.Background(), &pipeline, nil, testLogger)
+
+	// assert
+	utils.AssertTrue(t, success)
+	for _, stage := range pipelineRun.Stages {
+		utils.AssertStringEqual(t, data.StageStatus["SUCCEEDED"], stage.Status)
+		utils.AssertEqual(t, 0, stage.ExitCode)
+
+		var logData, _ = os.ReadFile(stage.Attempts[0].LogFile)
+		utils.AssertTrue(t, strings.HasPrefix(string(logData), "dry run, would run: "))
+	}
+
+	// TODO: cleanup
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"pipeline/data"
+	"pipeline/utils"
+	"slices"
+	"strconv"
+)
+
+// stageLimits applies a stage's limits to the processes of an attempt at running it, and keeps track of the most
+// they use. Each step's process has its rlimits before it runs (so anything it spawns inherits them), and its process
+// group gets the nice level and io priority once it has started.
+// With a memory limit, the processes of every step share a cgroup (see createCgroup).
+type stageLimits struct {
+	limits         data.ProcessLimits
+	usage          *data.LimitsUsage
+	cgroup         *os.File // the cgroup's directory, processes are started in it. nil without one
+	rlimitFailures *os.File // the pipe the rlimits that couldn't be set are read from, while a process is starting
+	rlimitWriter   *os.File
+}
+
+func newStageLimits(limits data.ProcessLimits) *stageLimits {
+	var stageLimits = &stageLimits{limits: limits, usage: &data.LimitsUsage{Limits: limits}}
+	if limits.MemoryMB > 0 {
+		if err := stageLimits.createCgroup(); err != nil {
+			stageLimits.warn("memory_mb is limiting the address space of each process instead, no cgroup: " + err.Error())
+		}
+	}
+	return stageLimits
+}
+
+// warn records a limit that couldn't be applied, once even when every step runs into it
+func (l *stageLimits) warn(warning string) {
+	if !slices.Contains(l.usage.Warnings, warning) {
+		l.usage.Warnings = append(l.usage.Warnings, warning)
+	}
+}
+
+// the address space limit of each process in MB, memory_mb takes its place without a cgroup
+func (l *stageLimits) addressSpaceMB() int {
+	var limit = l.limits.AddressSpaceMB
+	if l.cgroup == nil && l.limits.MemoryMB > 0 && (limit == 0 || l.limits.MemoryMB < limit) {
+		limit = l.limits.MemoryMB
+	}
+	return limit
+}
+
+// record adds what a step's process used, once it has exited
+func (l *stageLimits) record(usage data.ResourceUsage) {
+	l.usage.CpuTimeMs += usage.UserCpuMs + usage.SystemCpuMs
+	l.usage.PeakMemoryKB = max(l.usage.PeakMemoryKB, usage.MaxRssKB)
+}
+
+// exceeded describes the limit a step's process was stopped for going over, or returns empty if it wasn't.
+// Processes going over the cpu time are sent SIGXCPU, ones going over the memory of the cgroup are OOM killed.
+func (l *stageLimits) exceeded(usage data.ResourceUsage, signal string) string {
+	if l.cgroup != nil && l.oomKilled() {
+		return "killed for going over its memory limit of " + strconv.Itoa(l.limits.MemoryMB) + "MB"
+	}
+
+	// a shell only reports the exit code of a process killed by it, but it used (at least) its cpu time
+	var cpuTime = utils.CpuTimeLimit(l.limits)
+	if cpuTime > 0 && (signal == "SIGXCPU" || usage.UserCpuMs+usage.SystemCpuMs >= cpuTime.Milliseconds()) {
+		return "stopped for going over its cpu time limit of " + l.limits.CpuTime
+	}
+	return ""
+}
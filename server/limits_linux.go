@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pipeline/utils"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the io classes and who ioprio_set applies to, see ioprio_set(2)
+var ioClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+const IOPRIO_WHO_PGRP = 2
+
+// to name the cgroups of attempts running at the same time
+var cgroupCount atomic.Int64
+
+// cgroupParent finds the cgroup (v2) the stages' cgroups are created in: the one named by the PIPELINE_CGROUP env
+// var, or the server's own. The memory controller has to be enabled for its children, which the server tries to
+// do, but can't while processes (like the server itself) are in it, so usually it needs delegating to the server.
+func cgroupParent() (string, error) {
+	var parent = os.Getenv("PIPELINE_CGROUP")
+	if parent == "" {
+		cgroups, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return "", err
+		}
+		// cgroup v2 is a single hierarchy, listed as "0::/path"
+		for _, line := range strings.Split(string(cgroups), "\n") {
+			if path, found := strings.CutPrefix(line, "0::"); found {
+				parent = filepath.Join("/sys/fs/cgroup", path)
+			}
+		}
+	}
+	if parent == "" {
+		return "", errors.New("cgroup v2 isn't available")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return "", errors.New(parent + " isn't a cgroup v2 directory")
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " memory ") {
+		if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory"), 0644); err != nil {
+			return "", errors.New("can't enable the memory controller in " + parent + ": " + err.Error())
+		}
+	}
+	return parent, nil
+}
+
+// createCgroup creates a cgroup for the attempt's processes limited to memory_mb, so they are OOM killed when they
+// go over it, rather than the server or anything else on the machine
+func (l *stageLimits) createCgroup() error {
+	parent, err := cgroupParent()
+	if err != nil {
+		return err
+	}
+
+	var dir = filepath.Join(parent, "pipeline-"+strconv.Itoa(os.Getpid())+"-"+strconv.FormatInt(cgroupCount.Add(1), 10))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	var bytes = strconv.FormatInt(int64(l.limits.MemoryMB)*1024*1024, 10)
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(bytes), 0644); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	// otherwise the processes would be swapped out instead of stopped, where swap is enabled
+	os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+
+	l.cgroup, err = os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return err
+	}
+	l.usage.Cgroup = dir
+	return nil
+}
+
+// prepare has the command started in the cgroup, and its rlimits set before it runs, so anything it spawns has
+// them too. It has to be called after setProcessGroup, and apply (or abandon) after the command is started.
+func (l *stageLimits) prepare(cmd *exec.Cmd) {
+	if l.cgroup != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(l.cgroup.Fd())
+	}
+
+	// go can't set the rlimits of the child it forks, so it's started through sh, which sets them with ulimit and
+	// execs the command (keeping its pid). The limits it can't set are written to a pipe for apply to warn about.
+	if cmd.Err != nil {
+		return
+	}
+	var fd = strconv.Itoa(3 + len(cmd.ExtraFiles))
+	var script strings.Builder
+	setRlimit := func(name string, soft string, hard string) {
+		// the hard limit can't go under the soft one, so which is set first depends on whether they are going down or up
+		var setSoft, setHard = "ulimit -S " + soft, "ulimit -H " + hard
+		script.WriteString("{ " + setSoft + " && " + setHard + " || " + setHard + " && " + setSoft + "; } 2>/dev/null || echo '" + name + "' >&" + fd + "\n")
+	}
+	if cpuTime := utils.CpuTimeLimit(l.limits); cpuTime > 0 {
+		// SIGXCPU at the soft limit, and SIGKILL a second later if it is ignored
+		var seconds = int64(cpuTime / time.Second)
+		setRlimit("cpu_time", "-t "+strconv.FormatInt(seconds, 10), "-t "+strconv.FormatInt(seconds+1, 10))
+	}
+	if addressSpace := l.addressSpaceMB(); addressSpace > 0 {
+		var kb = "-v " + strconv.Itoa(addressSpace*1024)
+		setRlimit("address space", kb, kb)
+	}
+	if l.limits.OpenFiles > 0 {
+		var files = "-n " + strconv.Itoa(l.limits.OpenFiles)
+		setRlimit("open_files", files, files)
+	}
+	if script.Len() == 0 {
+		return
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		l.warn("can't set the limits of processes: " + err.Error())
+		return
+	}
+	l.rlimitFailures, l.rlimitWriter = reader, writer
+	cmd.ExtraFiles = append(cmd.ExtraFiles, writer)
+	script.WriteString("exec \"$@\" " + fd + ">&-")
+	cmd.Args = append([]string{"sh", "-c", script.String(), "sh", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+}
+
+// apply warns about the rlimits sh couldn't set, once the process has started (and sh has exec'd the command), and
+// sets the nice level and io priority of its whole process group. Limits the server isn't allowed to set are
+// recorded as warnings.
+func (l *stageLimits) apply(pid int) {
+	if l.rlimitFailures != nil {
+		l.rlimitWriter.Close()
+		failures, _ := io.ReadAll(l.rlimitFailures)
+		l.rlimitFailures.Close()
+		l.rlimitFailures, l.rlimitWriter = nil, nil
+		for _, name := range strings.Split(strings.TrimSpace(string(failures)), "\n") {
+			if name != "" {
+				l.warn("can't set the " + name + " limit")
+			}
+		}
+	}
+
+	if l.limits.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PGRP, pid, l.limits.Nice); err != nil {
+			l.warn("can't set the nice level: " + err.Error())
+		}
+	}
+	if l.limits.IOClass != "" {
+		var level = 4
+		if l.limits.IOLevel != nil {
+			level = *l.limits.IOLevel
+		}
+		var priority = ioClasses[l.limits.IOClass]<<13 | level
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, IOPRIO_WHO_PGRP, uintptr(pid), uintptr(priority)); errno != 0 {
+			l.warn("can't set the io priority: " + errno.Error())
+		}
+	}
+}
+
+// abandon closes the pipe of the rlimits when the process couldn't be started
+func (l *stageLimits) abandon() {
+	if l.rlimitFailures != nil {
+		l.rlimitWriter.Close()
+		l.rlimitFailures.Close()
+		l.rlimitFailures, l.rlimitWriter = nil, nil
+	}
+}
+
+// oomKilled reports whether a process in the cgroup was killed for going over its memory
+func (l *stageLimits) oomKilled() bool {
+	events, err := os.ReadFile(filepath.Join(l.usage.Cgroup, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if count, found := strings.CutPrefix(line, "oom_kill "); found {
+			return strings.TrimSpace(count) != "0"
+		}
+	}
+	return false
+}
+
+// close records the most memory the cgroup's processes used at once and removes it, once they have all exited
+func (l *stageLimits) close() {
+	if l.cgroup == nil {
+		return
+	}
+
+	// memory.peak is only in linux 5.19 and later, the processes' max RSS is used otherwise
+	if peak, err := os.ReadFile(filepath.Join(l.usage.Cgroup, "memory.peak")); err == nil {
+		if bytes, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64); err == nil {
+			l.usage.PeakMemoryKB = max(l.usage.PeakMemoryKB, bytes/1024)
+		}
+	}
+
+	l.cgroup.Close()
+	if err := os.Remove(l.usage.Cgroup); err != nil {
+		l.warn("can't remove the cgroup, processes the task started may still be running: " + err.Error())
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+)
+
+func (l *stageLimits) createCgroup() error {
+	return errors.New("cgroups are only on linux")
+}
+
+func (l *stageLimits) prepare(cmd *exec.Cmd) {}
+
+// only the cpu time and memory used are recorded, the limits can't be applied to another process outside of linux
+func (l *stageLimits) apply(pid int) {
+	l.warn("limits aren't applied on " + runtime.GOOS + ", only on linux")
+}
+
+func (l *stageLimits) abandon() {}
+
+func (l *stageLimits) oomKilled() bool {
+	return false
+}
+
+func (l *stageLimits) close() {}
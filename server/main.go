@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"pipeline/data"
 	"pipeline/utils"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -45,6 +49,8 @@ func run(logger *logrus.Logger, args []string) {
 	runCmd := flag.NewFlagSet("run", flag.ContinueOnError)
 	definitionPath := runCmd.String("definition", "", "path to pipeline definition")
 	// varFile := runCmd.String("variables", "", "path to variables file")
+	parallel := runCmd.Bool("parallel", false, "run stages in parallel, overrides the definition")
+	maxParallel := runCmd.Int("max-parallel", 0, "max stages running at once when parallel, overrides the definition")
 	runCmd.Parse(args[2:])
 
 	// get definition file
@@ -53,6 +59,16 @@ func run(logger *logrus.Logger, args []string) {
 		return
 	}
 
+	// only override the definition with the flags that were actually passed
+	runCmd.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "parallel":
+			pipeline.Parallel = *parallel
+		case "max-parallel":
+			pipeline.MaxParallel = *maxParallel
+		}
+	})
+
 	var errors = utils.ValidatePipelineDefinition(pipeline, nil, logger)
 
 	if len(errors) > 0 {
@@ -60,8 +76,14 @@ func run(logger *logrus.Logger, args []string) {
 		return
 	}
 
-	if success, _ := runPipeline(pipeline, nil, logger); success {
+	// Ctrl-C (or being asked to terminate) cancels the run, so running stages get stopped and the run still gets saved
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if success, pipelineRun := runPipeline(ctx, pipeline, nil, logger); success {
 		logger.Info("Pipeline completed successfully")
+	} else if pipelineRun.Status == data.RunStatus["CANCELLED"] {
+		logger.Warn("Pipeline run cancelled")
 	} else {
 		logger.Error("Pipeline run failed")
 	}
@@ -76,24 +98,39 @@ func help() {
 	fmt.Println("AVAILABLE SUBCOMMANDS:")
 	fmt.Println("  run        Execute a pipeline definition file")
 	fmt.Println("  serve      Start the pipeline server with web UI")
+	fmt.Println("  agent      Run the stages a server has for this host's labels")
 	fmt.Println("  version    Display the version information")
 	fmt.Println("  help       Display this help message")
 	fmt.Println()
 	fmt.Println("RUN SUBCOMMAND OPTIONS:")
 	fmt.Println("  -definition <path>    Path to pipeline definition file (required)")
+	fmt.Println("  -parallel[=false]     Run stages in parallel (or not), overrides the definition")
+	fmt.Println("  -max-parallel <n>     Max stages running at once when parallel, overrides the definition")
 	fmt.Println()
 	fmt.Println("SERVE SUBCOMMAND:")
 	fmt.Println("  Starts a web server for managing pipelines through a UI")
 	fmt.Println("  Default port: 8080 (override with SERVER_PORT environment variable)")
 	fmt.Println()
+	fmt.Println("AGENT SUBCOMMAND OPTIONS:")
+	fmt.Println("  -server <url>         URL of the server to run stages for (default: PIPELINE_SERVER)")
+	fmt.Println("  -name <name>          Name of the agent (default: the hostname)")
+	fmt.Println("  -labels <a,b>         Labels of the agent, stages with runs_on run on agents with all of theirs")
+	fmt.Println("  -max-jobs <n>         Max jobs running at once (default: 1)")
+	fmt.Println()
 	fmt.Println("ENVIRONMENT VARIABLES:")
 	fmt.Println("  LOG_DIR       Directory for log files")
 	fmt.Println("  SERVER_PORT   Port for the web server (default: 8080)")
 	fmt.Println("  ENV          Environment mode")
+	fmt.Println("  MAX_PARALLEL  Cap on the number of stages any run can have running at once")
+	fmt.Println("  RESOURCE_CAPACITY  Resources the stages of every run share e.g. cpu=16,memory_mb=32000")
+	fmt.Println("  PIPELINE_CGROUP    cgroup (v2) directory the cgroups of stages with a memory limit are created in")
+	fmt.Println("  AGENT_TOKEN        Token agents have to send the server, set on both when agents can't be trusted")
 	fmt.Println()
 	fmt.Println("EXAMPLES:")
 	fmt.Println("  pipeline run --definition my-pipeline.json")
+	fmt.Println("  pipeline run --definition my-pipeline.json --parallel --max-parallel 4")
 	fmt.Println("  pipeline serve")
+	fmt.Println("  pipeline agent -server http://ci:8080 -labels gpu,linux")
 	fmt.Println("  pipeline version")
 	fmt.Println("  pipeline help")
 }
@@ -116,6 +153,7 @@ func serve(logger *logrus.Logger) {
 	}
 
 	initServer(logger)
+	Agents.serve(logger)
 	defineRoutes(router, logger)
 
 	router.StaticFile("/", "static/index.html")
@@ -153,6 +191,8 @@ func main() {
 		run(logger, os.Args)
 	case "serve":
 		serve(logger)
+	case "agent":
+		startAgent(logger, os.Args)
 	case "version":
 		logger.Info("Version: " + VERSION)
 	case "help":
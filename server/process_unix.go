@@ -0,0 +1,76 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"pipeline/data"
+	"runtime"
+	"syscall"
+)
+
+// names for the signals a task is most likely to be stopped by, anything else uses go's description of it
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+}
+
+// start the task in its own process group, so anything it spawns can be stopped along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// cmd is windows only, its command line is passed as is there
+func setCmdCommandLine(cmd *exec.Cmd, script string) {}
+
+// ask every process in the task's process group to stop
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// forcefully stop every process in the task's process group
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// the signal that stopped the task, or empty if it exited by itself
+func exitSignal(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+
+	if name, found := signalNames[status.Signal()]; found {
+		return name
+	}
+	return status.Signal().String()
+}
+
+// what the task's process used, along with the processes it waited for. The max RSS is of the largest of them
+func processUsage(state *os.ProcessState) data.ResourceUsage {
+	var usage = data.ResourceUsage{UserCpuMs: state.UserTime().Milliseconds(), SystemCpuMs: state.SystemTime().Milliseconds()}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return usage
+	}
+
+	// linux reports it in KB, macOS in bytes
+	usage.MaxRssKB = int64(rusage.Maxrss)
+	if runtime.GOOS == "darwin" {
+		usage.MaxRssKB /= 1024
+	}
+	usage.BlockReads, usage.BlockWrites = int64(rusage.Inblock), int64(rusage.Oublock)
+	usage.VoluntaryContextSwitches, usage.InvoluntaryContextSwitches = int64(rusage.Nvcsw), int64(rusage.Nivcsw)
+	return usage
+}
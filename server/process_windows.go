@@ -0,0 +1,49 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"pipeline/data"
+	"strconv"
+	"syscall"
+)
+
+// start the task in its own process group, so anything it spawns can be stopped along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// setCmdCommandLine passes script to cmd as is. exec would escape its quotes the way programs that split their
+// command line expect, which cmd doesn't, so quoted values would reach the script mangled. With /S, cmd only strips
+// the quotes around the whole script.
+func setCmdCommandLine(cmd *exec.Cmd, script string) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CmdLine = syscall.EscapeArg(cmd.Args[0]) + " /S /C \"" + script + "\""
+}
+
+// ask the task and every process it spawned to stop, windows has no SIGTERM so taskkill is the closest thing
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// forcefully stop the task and every process it spawned
+func killProcessGroup(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// windows processes aren't stopped by signals, taskkill just sets the exit code
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// only the cpu times of a process are known once it has exited on windows
+func processUsage(state *os.ProcessState) data.ResourceUsage {
+	return data.ResourceUsage{UserCpuMs: state.UserTime().Milliseconds(), SystemCpuMs: state.SystemTime().Milliseconds()}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"pipeline/data"
+	"pipeline/utils"
+	"slices"
+	"sync"
+)
+
+// sharedResources is what the stages of every run in the process share: named locks, only one stage can hold a lock
+// at a time so stages (of any pipeline) that use the same thing, e.g. a database, never run at the same time. And the
+// server's capacity (see utils.ServerCapacity), the stages running at once never need more than that.
+type sharedResources struct {
+	mutex    sync.Mutex
+	holders  map[string]data.RunLink // lock name -> the stage of a run holding it
+	inUse    map[string]int          // resource name -> how much the running stages need
+	released chan struct{}           // closed (and replaced) every time locks or resources are released
+}
+
+var SharedResources = &sharedResources{holders: make(map[string]data.RunLink), inUse: make(map[string]int), released: make(chan struct{})}
+
+// tryAcquire takes all of the stage's locks and the resources it needs for holder, or nothing if any lock is held by
+// another stage or there isn't enough left of capacity. Returns nil if they were taken, otherwise a channel that is
+// closed the next time any are released, and whether it was a lock that wasn't free
+func (l *sharedResources) tryAcquire(stage data.Stage, holder data.RunLink, capacity map[string]int) (<-chan struct{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, name := range stage.Locks {
+		if _, held := l.holders[name]; held {
+			return l.released, true
+		}
+	}
+	if !utils.FitsCapacity(stage.Resources, l.inUse, capacity) {
+		return l.released, false
+	}
+
+	for _, name := range stage.Locks {
+		l.holders[name] = holder
+	}
+	for name, amount := range stage.Resources {
+		l.inUse[name] += amount
+	}
+	return nil, false
+}
+
+// release gives up the stage's locks and resources, letting anything waiting on them try again
+func (l *sharedResources) release(stage data.Stage) {
+	if len(stage.Locks) == 0 && len(stage.Resources) == 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, name := range stage.Locks {
+		delete(l.holders, name)
+	}
+	for name, amount := range stage.Resources {
+		l.inUse[name] -= amount
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// heldBy returns the stage holding a lock, if it is held
+func (l *sharedResources) heldBy(name string) (data.RunLink, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	holder, held := l.holders[name]
+	return holder, held
+}
+
+// the stages (with their runs) that started the current run through pipeline stages, kept in the run's context.
+// They are waiting for it to finish, so it can never get the locks they hold
+type ancestorStagesKey struct{}
+
+func ancestorStages(ctx context.Context) []data.RunLink {
+	stages, _ := ctx.Value(ancestorStagesKey{}).([]data.RunLink)
+	return stages
+}
+
+func withAncestorStage(ctx context.Context, stage data.RunLink) context.Context {
+	return context.WithValue(ctx, ancestorStagesKey{}, append(slices.Clone(ancestorStages(ctx)), stage))
+}
+
+// heldByAncestor returns the first of the locks held by a stage that started the current run, if any
+func (l *sharedResources) heldByAncestor(ctx context.Context, names []string) (string, data.RunLink, bool) {
+	var ancestors = ancestorStages(ctx)
+	for _, name := range names {
+		if holder, held := l.heldBy(name); held && slices.Contains(ancestors, holder) {
+			return name, holder, true
+		}
+	}
+	return "", data.RunLink{}, false
+}
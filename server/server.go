@@ -1,18 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
 	"pipeline/data"
 	"pipeline/utils"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
-// TODO: also store a map of active runs?
 var Pipelines map[string]*data.PipelineItem = make(map[string]*data.PipelineItem, 20)
 
+type activeRun struct {
+	run    *data.PipelineRun
+	cancel context.CancelFunc
+}
+
+// the runs currently in progress, keyed by pipeline name (a pipeline can only have 1 active run)
+var ActiveRuns map[string]*activeRun = make(map[string]*activeRun, 20)
+
+// protects Pipelines statuses and ActiveRuns as runs start and finish in the background
+var runsMutex sync.Mutex
+
 const NUM_LAST_RUNS = 10 // this is a limit value for now
 
 func initServer(logger *logrus.Logger) {
@@ -107,8 +123,8 @@ func defineRoutes(router *gin.Engine, logger *logrus.Logger) {
 
 	// start a pipeline run
 	router.POST(pipeline+"/:name", func(c *gin.Context) {
-		var msg, statusCode = launchPipeline(c.Param("name"), logger)
-		c.JSON(statusCode, data.ApiErrorResponse{Message: msg})
+		var msg, runId, statusCode = launchPipeline(c.Param("name"), logger)
+		c.JSON(statusCode, data.LaunchPipelineResponse{Message: msg, RunId: runId})
 	})
 
 	// cancel a pipeline run
@@ -122,9 +138,30 @@ func defineRoutes(router *gin.Engine, logger *logrus.Logger) {
 		var runs, statusCode = getPipelineRuns(c.Param("name"), logger)
 		c.JSON(statusCode, runs)
 	})
+
+	// list the artifacts of a pipeline run, or download one with ?stage=<stage name>&path=<artifact path>
+	router.GET(pipeline+"/:name/runs/:id/artifacts", func(c *gin.Context) {
+		if c.Query("path") != "" {
+			var msg, filename, statusCode = getPipelineRunArtifact(c.Param("name"), c.Param("id"), c.Query("stage"), c.Query("path"), logger)
+			if statusCode != 200 {
+				c.JSON(statusCode, data.ApiErrorResponse{Message: msg})
+				return
+			}
+			c.FileAttachment(filename, filepath.Base(filename))
+			return
+		}
+
+		var artifacts, statusCode = getPipelineRunArtifacts(c.Param("name"), c.Param("id"), logger)
+		c.JSON(statusCode, artifacts)
+	})
+
+	defineAgentRoutes(router, logger)
 }
 
 func uploadPipelineDefinition(pipelineRequest *data.RegisterPipelineRequest, logger *logrus.Logger) (string, int) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
 	var registeredPipelines = loadRegisteredPipelines(logger)
 
 	if _, exists := registeredPipelines[pipelineRequest.PipelineDefinition.Name]; exists {
@@ -213,6 +250,9 @@ func registerPipelineFromFile(pipelineRequest *data.RegisterFilePath, logger *lo
 }
 
 func transformRegisteredPipelines(registeredPipelines *map[string]data.RegisteredPipeline, registeredPipelineResponses *[]data.RegisteredPipelineResponse) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
 	for name := range *registeredPipelines {
 		(*registeredPipelineResponses) = append(*registeredPipelineResponses, data.RegisteredPipelineResponse{
 			Name:    name,
@@ -223,6 +263,9 @@ func transformRegisteredPipelines(registeredPipelines *map[string]data.Registere
 }
 
 func getPipelineDetails(name string, logger *logrus.Logger) (*data.RegisteredPipelineDetails, int) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
 	var registeredPipelines = loadRegisteredPipelines(logger)
 
 	if _, exists := registeredPipelines[name]; !exists {
@@ -243,19 +286,32 @@ func getPipelineDetails(name string, logger *logrus.Logger) (*data.RegisteredPip
 	}
 
 	var details = data.RegisteredPipelineDetails{
-		Name:      pipeline.Name,
-		Stages:    pipeline.Stages,
-		Parallel:  pipeline.Parallel,
-		Variables: variables,
-		LastRun:   Pipelines[pipeline.Name].LastRun,
-		Status:    Pipelines[pipeline.Name].Status,
+		Name:        pipeline.Name,
+		Stages:      pipeline.Stages,
+		Parallel:    pipeline.Parallel,
+		MaxParallel: pipeline.MaxParallel,
+		Timeout:     pipeline.Timeout,
+		Shell:       pipeline.Shell,
+		QuoteVars:   pipeline.QuoteVars,
+		Env:         pipeline.Env,
+		InheritEnv:  pipeline.InheritEnv,
+		Capacity:    pipeline.Capacity,
+		Executors:   pipeline.Executors,
+		Executor:    pipeline.Executor,
+		Variables:   variables,
+		LastRun:     Pipelines[pipeline.Name].LastRun,
+		Status:      Pipelines[pipeline.Name].Status,
 	}
 
 	return &details, 200
 }
 
 func deletePipeline(name string, logger *logrus.Logger) (string, int) {
-	if Pipelines[name].Status == data.PipelineStatus["RUNNING"] {
+	// held throughout, so a run can't be launched while the pipeline is being deleted
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	if item, exists := Pipelines[name]; exists && item.Status == data.PipelineStatus["RUNNING"] {
 		logger.Warn("Pipeline " + name + " is running, cannot delete")
 		return "Pipeline is running, cannot delete", 409
 	}
@@ -278,7 +334,11 @@ func deletePipeline(name string, logger *logrus.Logger) (string, int) {
 }
 
 func editPipeline(name string, pipelineRequest *data.EditPipelineRequest, logger *logrus.Logger) (string, int) {
-	if Pipelines[name].Status == data.PipelineStatus["RUNNING"] {
+	// held throughout, so a run can't be launched while the pipeline is being edited
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	if item, exists := Pipelines[name]; exists && item.Status == data.PipelineStatus["RUNNING"] {
 		logger.Warn("Pipeline " + name + " is running, cannot edit")
 		return "Pipeline is running, cannot edit", 409
 	}
@@ -297,9 +357,18 @@ func editPipeline(name string, pipelineRequest *data.EditPipelineRequest, logger
 	}
 
 	var editPipeline = data.Pipeline{
-		Name:     pipelineRequest.Name,
-		Stages:   pipelineRequest.Stages,
-		Parallel: pipelineRequest.Parallel,
+		Name:        pipelineRequest.Name,
+		Stages:      pipelineRequest.Stages,
+		Parallel:    pipelineRequest.Parallel,
+		MaxParallel: pipelineRequest.MaxParallel,
+		Timeout:     pipelineRequest.Timeout,
+		Shell:       pipelineRequest.Shell,
+		QuoteVars:   pipelineRequest.QuoteVars,
+		Env:         pipelineRequest.Env,
+		InheritEnv:  pipelineRequest.InheritEnv,
+		Capacity:    pipelineRequest.Capacity,
+		Executors:   pipelineRequest.Executors,
+		Executor:    pipelineRequest.Executor,
 	}
 
 	var stages []data.Stage
@@ -307,9 +376,18 @@ func editPipeline(name string, pipelineRequest *data.EditPipelineRequest, logger
 	json.Unmarshal(b, &stages)
 
 	var editPipelineToValidate = data.Pipeline{
-		Name:     pipelineRequest.Name,
-		Stages:   stages,
-		Parallel: pipelineRequest.Parallel,
+		Name:        pipelineRequest.Name,
+		Stages:      stages,
+		Parallel:    pipelineRequest.Parallel,
+		MaxParallel: pipelineRequest.MaxParallel,
+		Timeout:     pipelineRequest.Timeout,
+		Shell:       pipelineRequest.Shell,
+		QuoteVars:   pipelineRequest.QuoteVars,
+		Env:         pipelineRequest.Env,
+		InheritEnv:  pipelineRequest.InheritEnv,
+		Capacity:    pipelineRequest.Capacity,
+		Executors:   pipelineRequest.Executors,
+		Executor:    pipelineRequest.Executor,
 	}
 
 	var errors = utils.ValidatePipelineDefinition(&editPipelineToValidate, &pipelineRequest.Variables, logger)
@@ -369,38 +447,132 @@ func editPipeline(name string, pipelineRequest *data.EditPipelineRequest, logger
 }
 
 // This whole web app is a security vulnerability and should be protected by auth, especially this operation
-func launchPipeline(name string, logger *logrus.Logger) (string, int) {
+// The run happens in the background, returns the id of the run that was started
+func launchPipeline(name string, logger *logrus.Logger) (string, string, int) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
 	if _, exists := Pipelines[name]; !exists {
 		logger.Warn("Pipeline with name '" + name + "' does not exist, can't launch")
-		return "Pipeline with name '" + name + "' does not exist", 404
+		return "Pipeline with name '" + name + "' does not exist", "", 404
 	}
 
 	if Pipelines[name].Status == data.PipelineStatus["RUNNING"] {
 		logger.Warn("Pipeline " + name + " is already running, will not start new run")
-		return "Pipeline is not running, will not start new run", 409
+		return "Pipeline is already running, will not start new run", "", 409
+	}
+
+	var pipeline, message, statusCode = loadPipeline(name, nil, logger)
+	if pipeline == nil {
+		return message, "", statusCode
+	}
+
+	var pipelineRun = &data.PipelineRun{Id: utils.GenerateId(), Name: name, StartedAt: time.Now(), Status: data.RunStatus["QUEUED"]}
+	ctx, cancel := context.WithCancel(context.Background())
+	startActiveRun(name, pipelineRun, cancel)
+
+	go func() {
+		defer cancel()
+		var successful, finishedRun = runPipeline(ctx, pipeline, pipelineRun, logger)
+		finishActiveRun(name, successful, finishedRun, logger)
+	}()
+
+	logger.Info("Launched pipeline " + name + " with run id " + pipelineRun.Id)
+	return "Pipeline launched", pipelineRun.Id, 202
+}
+
+// loadPipeline loads the definition of a registered pipeline and validates it with its variables, and the given
+// variables on top of them. Returns the pipeline ready to run, or why it couldn't be loaded with a status code
+func loadPipeline(name string, variableOverrides map[string]string, logger *logrus.Logger) (*data.Pipeline, string, int) {
+	var registeredPipelines = loadRegisteredPipelines(logger)
+	if _, exists := registeredPipelines[name]; !exists {
+		logger.Warn("Pipeline with name '" + name + "' is not registered, can't launch")
+		return nil, "Pipeline with name '" + name + "' does not exist", 404
+	}
+
+	var pipeline = utils.LoadDefinition(registeredPipelines[name].Path, logger)
+	if pipeline == nil {
+		logger.Error("Couldn't load definition for pipeline with name '" + name + "'")
+		return nil, "Couldn't load pipeline definition", 500
+	}
+
+	// validation loads the definition's variable file itself, unless it is given the variables
+	var variablesFile = registeredPipelines[name].VariablesFile
+	if variablesFile == "" && len(variableOverrides) > 0 {
+		variablesFile = pipeline.VariableFile
 	}
 
-	logger.Info("Launching pipeline " + name)
-	return name, 418
+	var variables *map[string]string
+	if variablesFile != "" || len(variableOverrides) > 0 {
+		var vars = utils.LoadPipelineVars(variablesFile, logger)
+		if vars == nil {
+			vars = map[string]string{} // unreadable, validation reports the variables that are missing
+		}
+		maps.Copy(vars, variableOverrides)
+		variables = &vars
+	}
+
+	var errors = utils.ValidatePipelineDefinition(pipeline, variables, logger)
+	if len(errors) > 0 {
+		logger.Warn("Invalid pipeline definition: " + strings.Join(errors, "\n"))
+		return nil, "Invalid pipeline definition: " + strings.Join(errors, "\n"), 400
+	}
+
+	return pipeline, "", 200
+}
+
+// startActiveRun marks a pipeline as running pipelineRun, which cancel stops. runsMutex must be held
+func startActiveRun(name string, pipelineRun *data.PipelineRun, cancel context.CancelFunc) {
+	Pipelines[name].Status = data.PipelineStatus["RUNNING"]
+	Pipelines[name].LastRun = pipelineRun.StartedAt.UnixMilli()
+	ActiveRuns[name] = &activeRun{run: pipelineRun, cancel: cancel}
+}
+
+// finishActiveRun marks a pipeline as no longer running, with the status its active run ended with
+func finishActiveRun(name string, successful bool, finishedRun data.PipelineRun, logger *logrus.Logger) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
+	delete(ActiveRuns, name)
+	if _, exists := Pipelines[name]; !exists {
+		return
+	}
+	if successful {
+		Pipelines[name].Status = data.PipelineStatus["COMPLETE"]
+	} else if finishedRun.Status == data.RunStatus["CANCELLED"] {
+		Pipelines[name].Status = data.PipelineStatus["CANCELLED"]
+	} else {
+		Pipelines[name].Status = data.PipelineStatus["FAILED"]
+	}
+	logger.Info("Pipeline " + name + " run " + finishedRun.Id + " finished with status: " + Pipelines[name].Status)
 }
 
+// The run is stopped in the background, running stages are terminated and it will be saved as cancelled
 func cancelPipeline(name string, logger *logrus.Logger) (string, int) {
+	runsMutex.Lock()
+	defer runsMutex.Unlock()
+
 	if _, exists := Pipelines[name]; !exists {
 		logger.Warn("Pipeline with name '" + name + "' does not exist, can't cancel")
 		return "Pipeline with name '" + name + "' does not exist", 404
 	}
 
-	if Pipelines[name].Status != data.PipelineStatus["RUNNING"] {
+	var active, running = ActiveRuns[name]
+	if Pipelines[name].Status != data.PipelineStatus["RUNNING"] || !running {
 		logger.Warn("Pipeline " + name + " is not running, cannot cancel")
 		return "Pipeline is not running, cannot cancel", 409
 	}
 
-	logger.Info("Cancelling pipeline " + name)
-	return name, 418
+	logger.Info("Cancelling pipeline " + name + " run " + active.run.Id)
+	active.cancel()
+	return "Pipeline run cancelling", 202
 }
 
 func getPipelineRuns(name string, logger *logrus.Logger) ([]data.PipelineRun, int) {
-	if _, exists := Pipelines[name]; !exists {
+	runsMutex.Lock()
+	var _, exists = Pipelines[name]
+	runsMutex.Unlock()
+	if !exists {
 		logger.Warn("Pipeline with name '" + name + "' does not exist, can't get runs")
 		return []data.PipelineRun{}, 404
 	}
@@ -411,3 +583,47 @@ func getPipelineRuns(name string, logger *logrus.Logger) ([]data.PipelineRun, in
 	var runs = loadPipelineRuns(logger, name, NUM_LAST_RUNS)
 	return runs, 200
 }
+
+func getPipelineRunArtifacts(name string, runId string, logger *logrus.Logger) ([]data.Artifact, int) {
+	runsMutex.Lock()
+	var _, exists = Pipelines[name]
+	runsMutex.Unlock()
+	if !exists {
+		logger.Warn("Pipeline with name '" + name + "' does not exist, can't get artifacts")
+		return []data.Artifact{}, 404
+	}
+
+	if !filepath.IsLocal(runId) || filepath.Base(runId) != runId {
+		logger.Warn("Invalid run id: " + runId)
+		return []data.Artifact{}, 400
+	}
+
+	logger.Info("Getting artifacts for " + name + " run " + runId)
+	return loadArtifacts(name, runId, logger), 200
+}
+
+func getPipelineRunArtifact(name string, runId string, stage string, artifactPath string, logger *logrus.Logger) (string, string, int) {
+	runsMutex.Lock()
+	var _, exists = Pipelines[name]
+	runsMutex.Unlock()
+	if !exists {
+		logger.Warn("Pipeline with name '" + name + "' does not exist, can't get artifact")
+		return "Pipeline with name '" + name + "' does not exist", "", 404
+	}
+
+	// the artifact has to be inside the run's artifact store
+	if !filepath.IsLocal(runId) || filepath.Base(runId) != runId || !filepath.IsLocal(stage) || filepath.Base(stage) != stage ||
+		!filepath.IsLocal(filepath.FromSlash(artifactPath)) {
+		logger.Warn("Invalid artifact requested: " + runId + " " + stage + " " + artifactPath)
+		return "Invalid artifact", "", 400
+	}
+
+	var filename = filepath.Join(artifactsDir(name, runId), stage, filepath.FromSlash(artifactPath))
+	if info, err := os.Stat(filename); err != nil || info.IsDir() {
+		logger.Warn("Artifact does not exist: " + filename)
+		return "Artifact does not exist", "", 404
+	}
+
+	logger.Info("Downloading artifact " + artifactPath + " of " + name + " run " + runId)
+	return "", filename, 200
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"pipeline/data"
+	"pipeline/utils"
+	"strings"
+	"testing"
+)
+
+// registerPipelineHelper uploads pipeline under a unique name like the register endpoint would, returns the name
+func registerPipelineHelper(t *testing.T, pipeline data.Pipeline) string {
+	pipeline.Name = pipeline.Name + utils.GenerateId()
+	var _, statusCode = uploadPipelineDefinition(&data.RegisterPipelineRequest{PipelineDefinition: pipeline}, testLogger)
+	utils.AssertEqual(t, 201, statusCode)
+	return pipeline.Name
+}
+
+func Test_editPipeline_ShouldKeepTheExecutorsOfThePipeline(t *testing.T) {
+	// arrange
+	var executors = map[string]data.Executor{"nas": {Type: "ssh", Host: "nas.local", User: "ci"}}
+	var name = registerPipelineHelper(t, data.Pipeline{Name: "test_edit_executors", Executors: executors, Executor: "nas",
+		Stages: []data.Stage{{Name: "backup", Task: "echo backup"}}})
+	var request = data.EditPipelineRequest{Name: name, Executors: executors, Executor: "nas",
+		Stages: []data.Stage{{Name: "backup", Task: "echo backup"}, {Name: "local", Task: "echo local", Executor: "local"}}}
+
+	// act
+	var msg, statusCode = editPipeline(name, &request, testLogger)
+	var details, detailsStatusCode = getPipelineDetails(name, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 200, statusCode)
+	utils.AssertStringEqual(t, "Pipeline updated", msg)
+	utils.AssertEqual(t, 200, detailsStatusCode)
+	utils.AssertStringEqual(t, "nas", details.Executor)
+	utils.AssertStringEqual(t, "ssh", details.Executors["nas"].Type)
+	utils.AssertStringEqual(t, "nas.local", details.Executors["nas"].Host)
+	utils.AssertStringEqual(t, "ci", details.Executors["nas"].User)
+	utils.AssertEqual(t, 2, len(details.Stages))
+
+	// TODO: cleanup
+}
+
+func Test_editPipeline_ShouldKeepTheCapacityOfThePipeline(t *testing.T) {
+	// arrange
+	var capacity = map[string]int{"test_licenses": 2}
+	var name = registerPipelineHelper(t, data.Pipeline{Name: "test_edit_capacity", Capacity: capacity,
+		Stages: []data.Stage{{Name: "compile", Task: "echo compile", Resources: map[string]int{"test_licenses": 1}}}})
+	var request = data.EditPipelineRequest{Name: name, Capacity: capacity,
+		Stages: []data.Stage{{Name: "compile", Task: "echo compile", Resources: map[string]int{"test_licenses": 2}}}}
+	var tooMuch = data.EditPipelineRequest{Name: name, Capacity: capacity,
+		Stages: []data.Stage{{Name: "compile", Task: "echo compile", Resources: map[string]int{"test_licenses": 3}}}}
+
+	// act
+	var _, statusCode = editPipeline(name, &request, testLogger)
+	var details, _ = getPipelineDetails(name, testLogger)
+	var msg, tooMuchStatusCode = editPipeline(name, &tooMuch, testLogger)
+
+	// assert
+	utils.AssertEqual(t, 200, statusCode)
+	utils.AssertEqual(t, 2, details.Capacity["test_licenses"])
+	utils.AssertEqual(t, 400, tooMuchStatusCode)
+	utils.AssertTrue(t, strings.Contains(msg, "more than the pipeline's capacity of 2"))
+
+	// TODO: cleanup
+}
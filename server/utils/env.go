@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"os"
+	"pipeline/data"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// env var names that look like they hold a secret, their values are masked in run records
+var secretEnvPattern = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|PRIVATE_?KEY|ACCESS_?KEY|CREDENTIAL|AUTH)`)
+
+const MASKED_VALUE = "********"
+
+// ResolveEnv builds the environment a stage's task runs with. It starts with the env vars inherited from
+// this process (based on the pipeline's inherit_env, stages run on other hosts don't inherit any), then the pipeline's
+// env, then the stage's own env entries on top.
+// The stage's entries are expected to have their variables injected already (see InjectStageVariables).
+func ResolveEnv(stage data.Stage, pipeline *data.Pipeline) []string {
+	var env []string
+	var index = make(map[string]int)
+	set := func(key string, value string) {
+		if i, exists := index[key]; exists {
+			env[i] = key + "=" + value
+			return
+		}
+		index[key] = len(env)
+		env = append(env, key+"="+value)
+	}
+
+	var inherit data.InheritEnv
+	if pipeline != nil {
+		inherit = pipeline.InheritEnv
+	}
+	if !inherit.None() && !IsRemote(ResolveExecutor(stage, pipeline)) {
+		for _, entry := range os.Environ() {
+			key, value, _ := strings.Cut(entry, "=")
+			if key == "" {
+				continue // windows keeps some hidden per drive entries like "=C:=C:\"
+			}
+			if inherit.All() || slices.Contains(inherit, key) {
+				set(key, value)
+			}
+		}
+	}
+
+	if pipeline != nil {
+		// sorted so the resulting environment is the same every run
+		var keys = make([]string, 0, len(pipeline.Env))
+		for key := range pipeline.Env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			set(key, injectVariables(pipeline.Env[key], pipeline.Variables))
+		}
+	}
+
+	for _, entry := range stage.Env {
+		key, value, _ := strings.Cut(entry, "=")
+		set(strings.TrimSpace(key), value)
+	}
+
+	return env
+}
+
+// MaskSecrets returns a copy of the env entries with the values of any that look like secrets masked.
+func MaskSecrets(env []string) []string {
+	var masked = make([]string, 0, len(env))
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		if secretEnvPattern.MatchString(key) {
+			masked = append(masked, key+"="+MASKED_VALUE)
+		} else {
+			masked = append(masked, entry)
+		}
+	}
+	return masked
+}
+
+// MaskSecretOutputs returns a copy of a stage's outputs with the values of any that look like secrets masked.
+func MaskSecretOutputs(outputs map[string]string) map[string]string {
+	if outputs == nil {
+		return nil
+	}
+
+	var masked = make(map[string]string, len(outputs))
+	for key, value := range outputs {
+		if secretEnvPattern.MatchString(key) {
+			masked[key] = MASKED_VALUE
+		} else {
+			masked[key] = value
+		}
+	}
+	return masked
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"encoding/json"
+	"pipeline/data"
+	"testing"
+)
+
+func Test_ResolveEnv_ShouldInheritAllEnvVarsByDefault(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_ENV", "inherited")
+
+	// act
+	var env = ResolveEnv(data.Stage{Env: []string{"FOO=bar"}}, &data.Pipeline{})
+
+	// assert
+	AssertContains(t, env, "PIPELINE_TEST_ENV=inherited")
+	AssertContains(t, env, "FOO=bar")
+}
+
+func Test_ResolveEnv_ShouldNotInheritEnvVarsWhenNone(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_ENV", "inherited")
+
+	// act
+	var env = ResolveEnv(data.Stage{Env: []string{"FOO=bar"}}, &data.Pipeline{InheritEnv: data.InheritEnv{"none"}})
+
+	// assert
+	AssertSliceEqual(t, []string{"FOO=bar"}, env)
+}
+
+func Test_ResolveEnv_ShouldOnlyInheritAllowedEnvVars(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_ALLOWED", "yes")
+	t.Setenv("PIPELINE_TEST_NOT_ALLOWED", "no")
+
+	// act
+	var env = ResolveEnv(data.Stage{}, &data.Pipeline{InheritEnv: data.InheritEnv{"PIPELINE_TEST_ALLOWED"}})
+
+	// assert
+	AssertSliceEqual(t, []string{"PIPELINE_TEST_ALLOWED=yes"}, env)
+}
+
+func Test_ResolveEnv_ShouldNotInheritEnvVarsForStagesRunOnOtherHosts(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_ENV", "inherited")
+	var pipeline = data.Pipeline{Env: map[string]string{"MODE": "full"}, Executors: map[string]data.Executor{"nas": {Type: "ssh", Host: "nas"}}}
+
+	// act
+	var env = ResolveEnv(data.Stage{Env: []string{"FOO=bar"}, Executor: "nas"}, &pipeline)
+
+	// assert
+	AssertSliceEqual(t, []string{"MODE=full", "FOO=bar"}, env)
+}
+
+func Test_ResolveEnv_ShouldLetStageEnvOverridePipelineEnvAndPipelineEnvOverrideInherited(t *testing.T) {
+	// arrange
+	t.Setenv("PIPELINE_TEST_ENV", "inherited")
+	var pipeline = data.Pipeline{
+		InheritEnv: data.InheritEnv{"PIPELINE_TEST_ENV"},
+		Env:        map[string]string{"PIPELINE_TEST_ENV": "pipeline", "B": "pipeline", "A": "pipeline"},
+	}
+
+	// act
+	var env = ResolveEnv(data.Stage{Env: []string{"B=stage", "C=stage"}}, &pipeline)
+
+	// assert
+	AssertSliceEqual(t, []string{"PIPELINE_TEST_ENV=pipeline", "A=pipeline", "B=stage", "C=stage"}, env)
+}
+
+func Test_MaskSecrets_ShouldMaskValuesOfSecretLookingEnvVars(t *testing.T) {
+	// act
+	var masked = MaskSecrets([]string{"PATH=/usr/bin", "GITHUB_TOKEN=abc", "db_password=hunter2", "AWS_SECRET_ACCESS_KEY=xyz", "MODE=full"})
+
+	// assert
+	AssertSliceEqual(t, []string{"PATH=/usr/bin", "GITHUB_TOKEN=" + MASKED_VALUE, "db_password=" + MASKED_VALUE, "AWS_SECRET_ACCESS_KEY=" + MASKED_VALUE, "MODE=full"}, masked)
+}
+
+func Test_MaskSecretOutputs_ShouldMaskValuesOfSecretLookingOutputs(t *testing.T) {
+	// act
+	var masked = MaskSecretOutputs(map[string]string{"new_count": "3", "upload_token": "abc"})
+
+	// assert
+	AssertStringEqual(t, "3", masked["new_count"])
+	AssertStringEqual(t, MASKED_VALUE, masked["upload_token"])
+}
+
+func Test_InheritEnv_ShouldUnmarshalModeOrListOfNames(t *testing.T) {
+	// arrange
+	var all, none, list struct {
+		InheritEnv data.InheritEnv `json:"inherit_env"`
+	}
+
+	// act
+	var allErr = json.Unmarshal([]byte(`{"inherit_env": "all"}`), &all)
+	var noneErr = json.Unmarshal([]byte(`{"inherit_env": "none"}`), &none)
+	var listErr = json.Unmarshal([]byte(`{"inherit_env": ["PATH", "HOME"]}`), &list)
+	var invalidErr = json.Unmarshal([]byte(`{"inherit_env": "some"}`), &list)
+
+	// assert
+	AssertTrue(t, allErr == nil && all.InheritEnv.All())
+	AssertTrue(t, noneErr == nil && none.InheritEnv.None())
+	AssertTrue(t, listErr == nil)
+	AssertSliceEqual(t, []string{"PATH", "HOME"}, list.InheritEnv)
+	AssertFalse(t, invalidErr == nil)
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"pipeline/data"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the executors every pipeline has, a pipeline's own executors can't use these names
+var BuiltinExecutors = map[string]data.Executor{
+	"local":   {Type: "local"},
+	"dry-run": {Type: "dry-run"},
+}
+
+var executorTypes = []string{"local", "ssh", "dry-run"}
+
+// ResolveExecutor returns the executor a stage's task runs with, a stage's own executor overrides the pipeline's.
+// Stages with runs_on are run by an agent.
+func ResolveExecutor(stage data.Stage, pipeline *data.Pipeline) data.Executor {
+	if len(stage.RunsOn) > 0 {
+		return data.Executor{Type: "agent"}
+	}
+
+	var name = stage.Executor
+	if name == "" && pipeline != nil {
+		name = pipeline.Executor
+	}
+	if name == "" {
+		name = "local"
+	}
+
+	if executor, builtin := BuiltinExecutors[name]; builtin {
+		return executor
+	}
+	if pipeline != nil {
+		return pipeline.Executors[name]
+	}
+	return data.Executor{}
+}
+
+// IsRemote reports whether an executor runs tasks on another host, which doesn't get the server's env or files
+func IsRemote(executor data.Executor) bool {
+	return executor.Type == "ssh" || executor.Type == "agent"
+}
+
+func validateExecutors(pipeline *data.Pipeline, logger *logrus.Logger) []string {
+	var errors []string
+
+	// sorted so the errors are in the same order every time
+	var names = make([]string, 0, len(pipeline.Executors))
+	for name := range pipeline.Executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var executor = pipeline.Executors[name]
+		if _, builtin := BuiltinExecutors[name]; builtin {
+			logger.Error("Invalid executor name, it is built in: " + name)
+			errors = append(errors, "Invalid executor '"+name+"': the name is taken by a built in executor")
+		}
+		if !slices.Contains(executorTypes, executor.Type) {
+			logger.Error("Invalid executor type: " + name + " " + executor.Type)
+			errors = append(errors, "Invalid executor '"+name+"': type '"+executor.Type+"', expected 'local', 'ssh' or 'dry-run'")
+		}
+		if executor.Type == "ssh" && executor.Host == "" {
+			logger.Error("Executor " + name + " is missing a host")
+			errors = append(errors, "Invalid executor '"+name+"': ssh needs a host to connect to")
+		}
+		if executor.Port < 0 || executor.Port > 65535 {
+			logger.Error("Invalid executor port: " + name + " " + strconv.Itoa(executor.Port))
+			errors = append(errors, "Invalid executor '"+name+"': port "+strconv.Itoa(executor.Port)+", must be from 1 to 65535 (default 22)")
+		}
+	}
+
+	if !executorDefined(pipeline, pipeline.Executor) {
+		logger.Error("Invalid pipeline executor: " + pipeline.Executor)
+		errors = append(errors, "Invalid pipeline executor '"+pipeline.Executor+"', it isn't a built in executor or one of the pipeline's executors")
+	}
+
+	return errors
+}
+
+func validateStageExecutor(pipeline *data.Pipeline, stage data.Stage, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	if stage.Pipeline != "" {
+		if stage.Executor != "" || len(stage.RunsOn) > 0 {
+			// its stages run the tasks, each with their own executor
+			logger.Error(stageLabel + " has an executor and a pipeline to run")
+			errors = append(errors, stageLabel+" runs a pipeline, executors go on its stages, not the stage itself")
+		}
+		return errors
+	}
+
+	for _, label := range stage.RunsOn {
+		if strings.TrimSpace(label) == "" {
+			logger.Error(stageLabel + " has an empty runs_on label")
+			errors = append(errors, stageLabel+" has an empty runs_on label")
+		}
+	}
+	if len(stage.RunsOn) > 0 && stage.Executor != "" {
+		logger.Error(stageLabel + " has both runs_on and an executor")
+		errors = append(errors, stageLabel+" has both runs_on and executor, only one can be set")
+	}
+
+	if !executorDefined(pipeline, stage.Executor) {
+		logger.Error(stageLabel + " has an unknown executor: " + stage.Executor)
+		errors = append(errors, stageLabel+" unknown executor '"+stage.Executor+"', it isn't a built in executor or one of the pipeline's executors")
+		return errors
+	}
+
+	var executor = ResolveExecutor(stage, pipeline)
+	if stage.Limits != nil && IsRemote(executor) {
+		logger.Error(stageLabel + " has limits, but runs on another host")
+		errors = append(errors, stageLabel+" runs on another host, limits can only be applied to the server's processes")
+	}
+	if IsRemote(executor) && (len(stage.Artifacts) > 0 || len(stage.NeedsArtifacts) > 0) {
+		// they are stored from and restored to the stage's pwd on the server
+		logger.Error(stageLabel + " has artifacts, but runs on another host")
+		errors = append(errors, stageLabel+" runs on another host, only stages run on the server can keep or need artifacts")
+	}
+
+	return errors
+}
+
+// executorDefined reports whether an executor name is built in, or one of the pipeline's. Empty means the default
+func executorDefined(pipeline *data.Pipeline, name string) bool {
+	if name == "" {
+		return true
+	}
+	if _, builtin := BuiltinExecutors[name]; builtin {
+		return true
+	}
+	_, defined := pipeline.Executors[name]
+	return defined
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"pipeline/data"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the io classes a stage's processes can be given, see ioprio_set(2)
+var IOClasses = []string{"realtime", "best-effort", "idle"}
+
+// CpuTimeLimit is how much cpu time each of a stage's processes can use, 0 if it isn't limited. Rlimits are in whole
+// seconds, so it is rounded up to the next one.
+func CpuTimeLimit(limits data.ProcessLimits) time.Duration {
+	duration, err := ParseDuration(limits.CpuTime)
+	if err != nil || duration == 0 {
+		return 0
+	}
+	if duration%time.Second != 0 {
+		duration = duration.Truncate(time.Second) + time.Second
+	}
+	return duration
+}
+
+func validateLimits(limits *data.ProcessLimits, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	if _, err := ParseDuration(limits.CpuTime); err != nil {
+		logger.Error(stageLabel + " has an invalid cpu_time limit: " + limits.CpuTime)
+		errors = append(errors, stageLabel+" invalid cpu_time limit '"+limits.CpuTime+"'")
+	}
+
+	var sizes = []struct {
+		name  string
+		value int
+	}{{"address_space_mb", limits.AddressSpaceMB}, {"memory_mb", limits.MemoryMB}, {"open_files", limits.OpenFiles}}
+	for _, size := range sizes {
+		if size.value < 0 {
+			logger.Error(stageLabel + " has a negative " + size.name + " limit")
+			errors = append(errors, stageLabel+" invalid "+size.name+" limit: "+strconv.Itoa(size.value)+", must be 0 (not limited) or more")
+		}
+	}
+
+	if limits.Nice < -20 || limits.Nice > 19 {
+		logger.Error(stageLabel + " has an invalid nice level: " + strconv.Itoa(limits.Nice))
+		errors = append(errors, stageLabel+" invalid nice level: "+strconv.Itoa(limits.Nice)+", must be from -20 to 19")
+	}
+
+	var validClass = limits.IOClass == ""
+	for _, class := range IOClasses {
+		validClass = validClass || limits.IOClass == class
+	}
+	if !validClass {
+		logger.Error(stageLabel + " has an invalid io_class: " + limits.IOClass)
+		errors = append(errors, stageLabel+" invalid io_class '"+limits.IOClass+"', expected 'realtime', 'best-effort' or 'idle'")
+	}
+	if limits.IOLevel != nil && (*limits.IOLevel < 0 || *limits.IOLevel > 7) {
+		logger.Error(stageLabel + " has an invalid io_level: " + strconv.Itoa(*limits.IOLevel))
+		errors = append(errors, stageLabel+" invalid io_level: "+strconv.Itoa(*limits.IOLevel)+", must be from 0 to 7")
+	} else if limits.IOLevel != nil && limits.IOClass == "" {
+		logger.Error(stageLabel + " has an io_level without an io_class")
+		errors = append(errors, stageLabel+" io_level needs an io_class, it is the priority within the class")
+	}
+
+	return errors
+}
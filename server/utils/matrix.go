@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"pipeline/data"
+	"sort"
+	"strings"
+)
+
+// ExpandMatrix replaces every matrix stage with an instance per combination of its values, named after the stage and
+// the values e.g. "transcribe (lang=en, model=small)". Stages that need the artifacts of a matrix stage get those of
+// every instance. Other stages are returned as they are.
+func ExpandMatrix(stages []data.Stage) []data.Stage {
+	var expanded = make([]data.Stage, 0, len(stages))
+	var instanceNames = make(map[string][]string)
+	for _, stage := range stages {
+		if len(stage.Matrix) == 0 {
+			expanded = append(expanded, stage)
+			continue
+		}
+
+		for _, values := range matrixCombinations(stage.Matrix) {
+			var instance = stage
+			instance.Name = MatrixInstanceName(stage.Name, values)
+			instance.Matrix = nil
+			instance.MatrixOf = stage.Name
+			instance.MatrixValues = values
+			expanded = append(expanded, instance)
+			instanceNames[stage.Name] = append(instanceNames[stage.Name], instance.Name)
+		}
+	}
+
+	for i, stage := range expanded {
+		var needsArtifacts []string
+		for _, needed := range stage.NeedsArtifacts {
+			if instances, isMatrix := instanceNames[needed]; isMatrix {
+				needsArtifacts = append(needsArtifacts, instances...)
+			} else {
+				needsArtifacts = append(needsArtifacts, needed)
+			}
+		}
+		expanded[i].NeedsArtifacts = needsArtifacts
+	}
+
+	return expanded
+}
+
+// MatrixInstanceName names an instance of a matrix stage after the values it runs with, in order of their keys
+func MatrixInstanceName(stageName string, values map[string]string) string {
+	var keys = make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs = make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+values[key])
+	}
+	return stageName + " (" + strings.Join(pairs, ", ") + ")"
+}
+
+// matrixCombinations returns every combination of the matrix's values, the values of the last key (in order) change first
+func matrixCombinations(matrix map[string][]string) []map[string]string {
+	var keys = make([]string, 0, len(matrix))
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var combinations = []map[string]string{{}}
+	for _, key := range keys {
+		var next = make([]map[string]string, 0, len(combinations)*len(matrix[key]))
+		for _, combination := range combinations {
+			for _, value := range matrix[key] {
+				var values = make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					values[k] = v
+				}
+				values[key] = value
+				next = append(next, values)
+			}
+		}
+		combinations = next
+	}
+
+	return combinations
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"pipeline/data"
+	"testing"
+)
+
+func Test_ExpandMatrix_ShouldCreateAnInstanceForEveryCombination(t *testing.T) {
+	// arrange
+	var stages = []data.Stage{
+		{Name: "build", Task: "make"},
+		{Name: "transcribe", Task: "transcribe", Matrix: map[string][]string{"model": {"small", "large"}, "lang": {"en", "es"}}, DependsOn: []string{"build"}},
+	}
+
+	// act
+	var expanded = ExpandMatrix(stages)
+
+	// assert
+	AssertEqual(t, 5, len(expanded))
+	AssertStringEqual(t, "build", expanded[0].Name)
+	AssertStringEqual(t, "", expanded[0].MatrixOf)
+
+	var names []string
+	for _, instance := range expanded[1:] {
+		names = append(names, instance.Name)
+		AssertStringEqual(t, "transcribe", instance.MatrixOf)
+		AssertStringEqual(t, "transcribe", instance.Task)
+		AssertSliceEqual(t, []string{"build"}, instance.DependsOn)
+		AssertEqual(t, 0, len(instance.Matrix))
+	}
+	AssertSliceEqual(t, []string{"transcribe (lang=en, model=small)", "transcribe (lang=en, model=large)",
+		"transcribe (lang=es, model=small)", "transcribe (lang=es, model=large)"}, names)
+	AssertMapEqual(t, map[string]string{"lang": "es", "model": "small"}, expanded[3].MatrixValues)
+}
+
+func Test_ExpandMatrix_ShouldNeedTheArtifactsOfEveryInstance(t *testing.T) {
+	// arrange
+	var stages = []data.Stage{
+		{Name: "build", Task: "make", Artifacts: []string{"dist"}},
+		{Name: "transcribe", Task: "transcribe", Artifacts: []string{"*.srt"}, Matrix: map[string][]string{"lang": {"en", "es"}}},
+		{Name: "publish", Task: "publish", DependsOn: []string{"build", "transcribe"}, NeedsArtifacts: []string{"build", "transcribe"}},
+	}
+
+	// act
+	var expanded = ExpandMatrix(stages)
+
+	// assert
+	AssertEqual(t, 4, len(expanded))
+	AssertSliceEqual(t, []string{"build", "transcribe"}, expanded[3].DependsOn)
+	AssertSliceEqual(t, []string{"build", "transcribe (lang=en)", "transcribe (lang=es)"}, expanded[3].NeedsArtifacts)
+}
+
+func Test_InjectStageVariables_ShouldInjectMatrixValuesOverVariables(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Variables: map[string]string{"lang": "de", "root": "/media"}}
+	var stage = ExpandMatrix([]data.Stage{{Name: "transcribe", Task: "transcribe {root} {lang}", Matrix: map[string][]string{"lang": {"en"}}}})[0]
+
+	// act
+	var injected, errors = InjectStageVariables(stage, &pipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertStringEqual(t, "transcribe /media en", injected.Task)
+}
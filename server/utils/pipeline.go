@@ -2,16 +2,28 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
 	"pipeline/data"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// the names of variables, matrix keys (injected like variables), outputs and resources
+var NameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// variables ({name}) and outputs of other stages ({stages.NAME.KEY}) injected in a string
+var injectedValueRegex = regexp.MustCompile(`{(?:stages\.([^.{}]+)\.([a-zA-Z0-9_]+)|([a-zA-Z0-9_]+))}`)
+var outputReferenceRegex = regexp.MustCompile(`{stages\.([^.{}]+)\.[a-zA-Z0-9_]+}`)
+
 func validateVars(str string, variables map[string]string) []string {
 	var missing []string
 
@@ -67,6 +79,44 @@ func ValidatePipelineDefinition(pipeline *data.Pipeline, vars *map[string]string
 		variables = *vars
 	}
 
+	if pipeline.MaxParallel < 0 {
+		logger.Error("Invalid pipeline max_parallel: " + strconv.Itoa(pipeline.MaxParallel))
+		errors = append(errors, "Invalid pipeline max_parallel: "+strconv.Itoa(pipeline.MaxParallel)+", must be 0 (default) or more")
+	}
+
+	if _, err := ParseDuration(pipeline.Timeout); err != nil {
+		logger.Error("Invalid pipeline timeout: " + pipeline.Timeout)
+		errors = append(errors, "Invalid pipeline timeout: '"+pipeline.Timeout+"'")
+	}
+
+	if len(pipeline.InheritEnv) > 1 && (slices.Contains(pipeline.InheritEnv, "all") || slices.Contains(pipeline.InheritEnv, "none")) {
+		logger.Error("Invalid pipeline inherit_env, 'all' and 'none' can't be part of a list")
+		errors = append(errors, "Invalid pipeline inherit_env: 'all' and 'none' can't be part of a list of env var names")
+	}
+
+	// check for missing vars included in the pipeline env values
+	for key, value := range pipeline.Env {
+		if key == "" || strings.Contains(key, "=") {
+			logger.Error("Invalid pipeline env name: '" + key + "'")
+			errors = append(errors, "Invalid pipeline env name: '"+key+"'")
+			continue
+		}
+		errors = append(errors, validateVars(value, variables)...)
+		if len(findOutputReferences(value)) > 0 {
+			logger.Error("Pipeline env " + key + " references stage outputs")
+			errors = append(errors, "Invalid pipeline env '"+key+"': stage outputs can only be used in a stage's env")
+		}
+	}
+
+	for name, amount := range pipeline.Capacity {
+		if !NameRegex.MatchString(name) || amount < 1 {
+			logger.Error("Invalid pipeline capacity: " + name + "=" + strconv.Itoa(amount))
+			errors = append(errors, "Invalid pipeline capacity '"+name+"': "+strconv.Itoa(amount)+", the name must only contain letters, digits and _ and the amount be more than 0")
+		}
+	}
+	var serverCapacity = ServerCapacity(logger)
+	errors = append(errors, validateExecutors(pipeline, logger)...)
+
 	// validate stages
 	if len(pipeline.Stages) == 0 {
 		logger.Error("Pipeline has no stages")
@@ -87,66 +137,225 @@ func ValidatePipelineDefinition(pipeline *data.Pipeline, vars *map[string]string
 			stageNames[stage.Name] = true
 		}
 
-		// TODO: if support multiple tasks per stage update this check
-		if stage.Task == "" {
+		if stage.Task == "" && len(stage.Steps) == 0 && stage.Pipeline == "" {
 			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") stage task is missing")
 			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") stage task is missing")
+		} else if stage.Task != "" && len(stage.Steps) > 0 {
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has both a task and steps")
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") has both task and steps, only one can be set")
+		} else if stage.Pipeline != "" && (stage.Task != "" || len(stage.Steps) > 0) {
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has a pipeline and a task or steps")
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") has a pipeline to run, it can't have a task or steps too")
 		}
 
-		// check for missing vars included in the task string
-		var taskVariableErrors = validateVars(stage.Task, variables)
-		if len(taskVariableErrors) > 0 {
-			errors = append(errors, taskVariableErrors...)
-		} else {
-			pipeline.Stages[i].Task = injectVariables(stage.Task, variables)
+		if _, err := ParseDuration(stage.Timeout); err != nil {
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has an invalid timeout: " + stage.Timeout)
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") invalid timeout '"+stage.Timeout+"'")
 		}
 
-		// check for missing vars included in the pwd string
-		var pwdVariableErrors = validateVars(stage.Pwd, variables)
-		if len(pwdVariableErrors) > 0 {
-			errors = append(errors, pwdVariableErrors...)
-		} else {
-			pipeline.Stages[i].Pwd = injectVariables(stage.Pwd, variables)
+		if stage.RunOn != "" && stage.RunOn != "success" && stage.RunOn != "failure" && stage.RunOn != "always" {
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has an invalid run_on: " + stage.RunOn)
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") invalid run_on '"+stage.RunOn+"', expected 'success', 'failure' or 'always'")
+		} else if stage.RunOn == "failure" && len(stage.DependsOn) == 0 {
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has run_on failure without any dependencies")
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") run_on 'failure' needs depends_on, it runs when one of them fails")
+		}
+
+		if stage.Retry != nil {
+			errors = append(errors, validateRetryPolicy(stage.Retry, stage.Name+" ("+strconv.Itoa(i)+")", logger)...)
+		}
+
+		if len(stage.Resources) > 0 && stage.Pipeline != "" {
+			// the stages of the pipeline it runs say what they need, the stage would hold on to it while they wait for it
+			logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has resources and a pipeline to run")
+			errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") runs a pipeline, its stages need resources, not the stage itself")
 		}
+		errors = append(errors, validateResources(stage.Resources, pipeline.Capacity, serverCapacity, stage.Name+" ("+strconv.Itoa(i)+")", logger)...)
 
-		// check for missing vars included in any of the task args
-		for j, arg := range stage.Args {
-			var argVariableErrors = validateVars(arg, variables)
-			if len(argVariableErrors) > 0 {
-				errors = append(errors, argVariableErrors...)
+		for _, lock := range stage.Locks {
+			if strings.TrimSpace(lock) == "" {
+				logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has an empty lock name")
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") has an empty lock name")
+			}
+		}
+
+		if stage.Limits != nil {
+			if stage.Pipeline != "" {
+				// its stages run the processes, the limits go on them
+				logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") has limits and a pipeline to run")
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") runs a pipeline, limits go on its stages, not the stage itself")
+			}
+			errors = append(errors, validateLimits(stage.Limits, stage.Name+" ("+strconv.Itoa(i)+")", logger)...)
+		}
+		errors = append(errors, validateStageExecutor(pipeline, stage, stage.Name+" ("+strconv.Itoa(i)+")", logger)...)
+
+		// check for missing vars and outputs of other stages included in the task string, pwd string and any of the
+		// task args. They are only injected right before the stage starts (see InjectStageVariables), once the
+		// outputs are known
+		var stageLabel = stage.Name + " (" + strconv.Itoa(i) + ")"
+		var stageVariables = variables
+		if len(stage.Matrix) > 0 {
+			errors = append(errors, validateMatrix(stage, stageLabel, logger)...)
+			stageVariables = make(map[string]string, len(variables)+len(stage.Matrix))
+			maps.Copy(stageVariables, variables)
+			for key := range stage.Matrix {
+				stageVariables[key] = "" // each instance gets its own value
+			}
+		}
+		errors = append(errors, validatePipelineStage(pipeline, stage, stageVariables, stageLabel, logger)...)
+		errors = append(errors, validateVars(stage.Task, stageVariables)...)
+		errors = append(errors, validateOutputReferences(stage.Task, stage, pipeline, stageLabel, logger)...)
+		errors = append(errors, validateVars(stage.Pwd, stageVariables)...)
+		errors = append(errors, validateOutputReferences(stage.Pwd, stage, pipeline, stageLabel, logger)...)
+		for _, arg := range stage.Args {
+			errors = append(errors, validateVars(arg, stageVariables)...)
+			errors = append(errors, validateOutputReferences(arg, stage, pipeline, stageLabel, logger)...)
+		}
+
+		// steps are checked like the task, args and env of the stage
+		for j, step := range stage.Steps {
+			var stepLabel = stageLabel + " step " + strconv.Itoa(j+1)
+			if step.Task == "" {
+				logger.Error(stepLabel + " task is missing")
+				errors = append(errors, stepLabel+" task is missing")
+			}
+			errors = append(errors, validateVars(step.Task, stageVariables)...)
+			errors = append(errors, validateOutputReferences(step.Task, stage, pipeline, stageLabel, logger)...)
+			for _, arg := range step.Args {
+				errors = append(errors, validateVars(arg, stageVariables)...)
+				errors = append(errors, validateOutputReferences(arg, stage, pipeline, stageLabel, logger)...)
+			}
+			for _, env := range step.Env {
+				var validatedEnv, envFormatError = validateKeyValuePair(env)
+				if envFormatError != "" {
+					errors = append(errors, envFormatError)
+					continue
+				}
+				errors = append(errors, validateVars(validatedEnv, stageVariables)...)
+				errors = append(errors, validateOutputReferences(validatedEnv, stage, pipeline, stageLabel, logger)...)
+			}
+		}
+
+		// the stages the when condition checks must have finished before it can be evaluated, so they have to be dependencies
+		if stage.When != "" {
+			var whenVariableErrors = validateVars(stage.When, stageVariables)
+			if len(whenVariableErrors) > 0 {
+				errors = append(errors, whenVariableErrors...)
 			} else {
-				pipeline.Stages[i].Args[j] = injectVariables(stage.Args[j], variables)
+				errors = append(errors, validateWhen(pipeline, stage, stageVariables, stageLabel, logger)...)
 			}
 		}
 
 		// check for missing vars included in any of the env entries and verify each arg entry is in correct format
-		for j, env := range stage.Env {
+		for _, env := range stage.Env {
 			var validatedEnv, envFormatError = validateKeyValuePair(env)
 			if envFormatError != "" {
 				errors = append(errors, envFormatError)
 				continue
 			}
-			var envVariableErrors = validateVars(validatedEnv, variables)
-			if len(envVariableErrors) > 0 {
-				errors = append(errors, envVariableErrors...)
-			} else {
-				pipeline.Stages[i].Env[j] = injectVariables(validatedEnv, variables)
+			errors = append(errors, validateVars(validatedEnv, stageVariables)...)
+			errors = append(errors, validateOutputReferences(validatedEnv, stage, pipeline, stageLabel, logger)...)
+		}
+
+		// artifacts are stored in a directory named after the stage, and must not be taken from outside its pwd
+		for _, pattern := range stage.Artifacts {
+			if _, err := filepath.Match(pattern, ""); err != nil || !filepath.IsLocal(pattern) {
+				logger.Error(stageLabel + " has an invalid artifacts pattern: " + pattern)
+				errors = append(errors, stageLabel+" invalid artifacts pattern '"+pattern+"', must be a glob relative to the stage's pwd")
+			}
+		}
+		if len(stage.Artifacts) > 0 && (stage.Name == "." || stage.Name == ".." || strings.ContainsAny(stage.Name, `/\`)) {
+			logger.Error(stageLabel + " has artifacts but its name can't be used as a directory name")
+			errors = append(errors, stageLabel+" has artifacts, its name can't contain '/' or '\\', or be '.' or '..'")
+		}
+	}
+
+	// dependencies are checked once every stage name is known, so a stage can depend on one defined after it
+	for i, stage := range pipeline.Stages {
+		for _, dependency := range stage.DependsOn {
+			var _, dependencyExists = stageNames[dependency]
+			if !dependencyExists {
+				logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") depends on a non-existent stage: " + dependency)
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") dependency '"+dependency+"' has not been defined")
+			}
+			if dependency == stage.Name {
+				logger.Error("Cannot have self as a dependency " + stage.Name)
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") listed self as dependency")
 			}
 		}
 
-		// since the intention is to run stages in the order they are defined, it should be fine to use the
-		// stage name map in the current state to check for dependencies
-		if len(stage.DependsOn) > 0 {
-			for _, dependency := range stage.DependsOn {
-				var _, dependencyExists = stageNames[dependency]
-				if !dependencyExists {
-					logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") depends on a non-existent stage: " + dependency)
-					errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") dependency '"+dependency+"' has not been defined")
-				}
-				if dependency == stage.Name {
-					logger.Error("Cannot have self as a dependency " + stage.Name)
-					errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") listed self as dependency")
-				}
+		// artifacts are only stored once the stage that makes them has finished
+		for _, needed := range stage.NeedsArtifacts {
+			var neededIndex = slices.IndexFunc(pipeline.Stages, func(s data.Stage) bool { return s.Name == needed })
+			if !slices.Contains(stage.DependsOn, needed) {
+				logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") needs artifacts of a stage it doesn't depend on: " + needed)
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") needs artifacts of '"+needed+"', which must be listed in depends_on")
+			} else if neededIndex != -1 && len(pipeline.Stages[neededIndex].Artifacts) == 0 {
+				logger.Error(stage.Name + " ( index - " + strconv.Itoa(i) + ") needs artifacts of a stage without any: " + needed)
+				errors = append(errors, stage.Name+" ("+strconv.Itoa(i)+") needs artifacts of '"+needed+"', which doesn't declare any")
+			}
+		}
+	}
+
+	for _, cycle := range findDependencyCycles(pipeline.Stages) {
+		logger.Error("Dependency cycle detected: " + cycle)
+		errors = append(errors, "Dependency cycle detected: "+cycle)
+	}
+
+	pipeline.Variables = variables
+	return errors
+}
+
+// a pipeline stage runs another registered pipeline, which is only checked when the stage starts (it can be registered
+// later), except that it can't be the pipeline the stage is part of
+func validatePipelineStage(pipeline *data.Pipeline, stage data.Stage, variables map[string]string, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	if stage.Pipeline != "" && stage.Pipeline == pipeline.Name {
+		logger.Error(stageLabel + " runs the pipeline it is part of")
+		errors = append(errors, stageLabel+" can't run the pipeline it's part of ('"+stage.Pipeline+"')")
+	}
+
+	if len(stage.Variables) > 0 && stage.Pipeline == "" {
+		logger.Error(stageLabel + " has variables but no pipeline to run")
+		errors = append(errors, stageLabel+" has variables, but no pipeline to pass them to")
+	}
+
+	for key, value := range stage.Variables {
+		if !NameRegex.MatchString(key) {
+			logger.Error(stageLabel + " has an invalid variable name: " + key)
+			errors = append(errors, stageLabel+" invalid variable name '"+key+"', must only contain letters, digits and _")
+		}
+		errors = append(errors, validateVars(value, variables)...)
+		errors = append(errors, validateOutputReferences(value, stage, pipeline, stageLabel, logger)...)
+	}
+
+	return errors
+}
+
+// matrix keys are injected like variables, and the instances' names (made from the values) have to be usable as
+// directory names if the stage has artifacts
+func validateMatrix(stage data.Stage, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	if stage.MaxParallel < 0 {
+		logger.Error(stageLabel + " has an invalid max_parallel: " + strconv.Itoa(stage.MaxParallel))
+		errors = append(errors, stageLabel+" invalid max_parallel: "+strconv.Itoa(stage.MaxParallel)+", must be 0 (no limit) or more")
+	}
+
+	for key, values := range stage.Matrix {
+		if !NameRegex.MatchString(key) {
+			logger.Error(stageLabel + " has an invalid matrix key: " + key)
+			errors = append(errors, stageLabel+" invalid matrix key '"+key+"', must only contain letters, digits and _")
+		}
+		if len(values) == 0 {
+			logger.Error(stageLabel + " has a matrix key without values: " + key)
+			errors = append(errors, stageLabel+" matrix key '"+key+"' has no values")
+		}
+		for _, value := range values {
+			if len(stage.Artifacts) > 0 && strings.ContainsAny(value, `/\`) {
+				logger.Error(stageLabel + " has artifacts and a matrix value that can't be used in a directory name: " + value)
+				errors = append(errors, stageLabel+" has artifacts, its matrix value '"+value+"' can't contain '/' or '\\'")
 			}
 		}
 	}
@@ -154,6 +363,120 @@ func ValidatePipelineDefinition(pipeline *data.Pipeline, vars *map[string]string
 	return errors
 }
 
+func validateWhen(pipeline *data.Pipeline, stage data.Stage, variables map[string]string, stageLabel string, logger *logrus.Logger) []string {
+	var errors = validateOutputReferences(stage.When, stage, pipeline, stageLabel, logger)
+
+	// outputs aren't known until the stages before it have run, they are checked as empty strings
+	var when, _ = injectValues(stage.When, variables, nil, quoteWhenValue)
+	references, err := ParseWhen(when, stage.DependsOn)
+	if err != nil {
+		logger.Error(stageLabel + " has an invalid when condition: " + err.Error())
+		errors = append(errors, stageLabel+" invalid when condition: "+err.Error())
+	}
+
+	for _, reference := range references {
+		if !slices.Contains(stage.DependsOn, reference) {
+			logger.Error(stageLabel + " when condition references a stage it doesn't depend on: " + reference)
+			errors = append(errors, stageLabel+" when condition references '"+reference+"', which must be listed in depends_on")
+		}
+	}
+
+	return errors
+}
+
+func validateRetryPolicy(retry *data.RetryPolicy, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	if retry.MaxAttempts < 1 {
+		logger.Error(stageLabel + " retry max_attempts must be at least 1")
+		errors = append(errors, stageLabel+" retry max_attempts must be at least 1")
+	}
+
+	if retry.Backoff != "" && retry.Backoff != "fixed" && retry.Backoff != "exponential" {
+		logger.Error(stageLabel + " has an invalid retry backoff: " + retry.Backoff)
+		errors = append(errors, stageLabel+" invalid retry backoff '"+retry.Backoff+"', expected 'fixed' or 'exponential'")
+	}
+
+	if _, err := ParseDuration(retry.Delay); err != nil {
+		logger.Error(stageLabel + " has an invalid retry delay: " + retry.Delay)
+		errors = append(errors, stageLabel+" invalid retry delay '"+retry.Delay+"'")
+	}
+
+	if _, err := ParseDuration(retry.MaxDelay); err != nil {
+		logger.Error(stageLabel + " has an invalid retry max_delay: " + retry.MaxDelay)
+		errors = append(errors, stageLabel+" invalid retry max_delay '"+retry.MaxDelay+"'")
+	}
+
+	return errors
+}
+
+// findDependencyCycles walks the dependency graph of the stages and returns every cycle found,
+// formatted as the path of stage names that make it up, e.g. "a -> b -> c -> a".
+// Self dependencies and dependencies on undefined stages are reported separately, so they are ignored here.
+func findDependencyCycles(stages []data.Stage) []string {
+	var cycles []string
+
+	dependencies := make(map[string][]string, len(stages))
+	for _, stage := range stages {
+		dependencies[stage.Name] = stage.DependsOn
+	}
+
+	// 0 - not visited, 1 - on the current path, 2 - fully explored
+	state := make(map[string]int, len(stages))
+	var path []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = 1
+		path = append(path, name)
+
+		for _, dependency := range dependencies[name] {
+			if _, exists := dependencies[dependency]; !exists || dependency == name {
+				continue
+			}
+
+			switch state[dependency] {
+			case 0:
+				visit(dependency)
+			case 1:
+				// found our way back to a stage on the current path, the cycle is everything from there on
+				start := slices.Index(path, dependency)
+				cycle := append(slices.Clone(path[start:]), dependency)
+				cycles = append(cycles, strings.Join(cycle, " -> "))
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = 2
+	}
+
+	for _, stage := range stages {
+		if state[stage.Name] == 0 {
+			visit(stage.Name)
+		}
+	}
+
+	return cycles
+}
+
+// ParseDuration converts a duration from a pipeline definition, like a timeout or retry delay (a Go duration
+// string like "90s" or "1h30m") to a time.Duration. An empty string means it isn't set and is returned as 0.
+func ParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be greater than 0")
+	}
+
+	return duration, nil
+}
+
 func LoadDefinition(definitionPath string, logger *logrus.Logger) *data.Pipeline {
 	if definitionPath == "" {
 		logger.Error("Missing pipeline definition path")
@@ -220,11 +543,129 @@ func LoadPipelineVars(varFile string, logger *logrus.Logger) map[string]string {
 }
 
 func injectVariables(task string, variables map[string]string) string {
-	re := regexp.MustCompile(`{([a-zA-Z0-9_]+)}`)
-	return re.ReplaceAllStringFunc(task, func(match string) string {
-		varName := match[1 : len(match)-1]
-		return variables[varName]
+	var result, _ = injectValues(task, variables, nil, nil)
+	return result
+}
+
+// injectValues replaces the variables ({name}) and outputs of other stages ({stages.NAME.KEY}) in str with their
+// values, passed through quote if it is set. Returns a message for each output that doesn't exist.
+func injectValues(str string, variables map[string]string, outputs map[string]map[string]string, quote func(string) string) (string, []string) {
+	var missing []string
+
+	var result = injectedValueRegex.ReplaceAllStringFunc(str, func(match string) string {
+		var groups = injectedValueRegex.FindStringSubmatch(match)
+		var value string
+		if groups[3] != "" {
+			value = variables[groups[3]]
+		} else if output, exists := outputs[groups[1]][groups[2]]; exists {
+			value = output
+		} else {
+			missing = append(missing, "Missing output: stages."+groups[1]+"."+groups[2])
+		}
+
+		if quote != nil {
+			return quote(value)
+		}
+		return value
 	})
+
+	return result, missing
+}
+
+// findOutputReferences returns the names of the stages whose outputs ({stages.NAME.KEY}) are used in str
+func findOutputReferences(str string) []string {
+	var stages []string
+
+	for _, result := range outputReferenceRegex.FindAllStringSubmatch(str, -1) {
+		stages = append(stages, result[1])
+	}
+
+	return stages
+}
+
+// the stages whose outputs are used have to finish before the stage starts, so they have to be dependencies (that
+// aren't matrix stages)
+func validateOutputReferences(str string, stage data.Stage, pipeline *data.Pipeline, stageLabel string, logger *logrus.Logger) []string {
+	var errors []string
+
+	for _, reference := range findOutputReferences(str) {
+		if !slices.Contains(stage.DependsOn, reference) {
+			logger.Error(stageLabel + " uses outputs of a stage it doesn't depend on: " + reference)
+			errors = append(errors, stageLabel+" uses outputs of '"+reference+"', which must be listed in depends_on")
+		}
+		// each instance of a matrix stage has its own outputs, there's no telling which one is meant
+		for _, other := range pipeline.Stages {
+			if other.Name == reference && len(other.Matrix) > 0 {
+				logger.Error(stageLabel + " uses outputs of a matrix stage: " + reference)
+				errors = append(errors, stageLabel+" uses outputs of '"+reference+"', a matrix stage's outputs can't be used by name as each of its instances has its own")
+			}
+		}
+	}
+
+	return errors
+}
+
+// InjectStageVariables fills in the variables and the outputs of earlier stages used by a stage, right before it
+// starts. When the task (or a step's task) is run through a shell the values injected into it can be quoted, so they are
+// literal words. The variables a pipeline stage passes to the pipeline it runs can use them too.
+// The values of an instance of a matrix stage are injected as variables too, over any of the same name.
+// Returns a copy of the stage with the values injected, and a message for each missing output.
+func InjectStageVariables(stage data.Stage, pipeline *data.Pipeline, outputs map[string]map[string]string) (data.Stage, []string) {
+	var variables = pipeline.Variables
+	if len(stage.MatrixValues) > 0 {
+		variables = make(map[string]string, len(pipeline.Variables)+len(stage.MatrixValues))
+		maps.Copy(variables, pipeline.Variables)
+		maps.Copy(variables, stage.MatrixValues)
+	}
+
+	var errors []string
+	inject := func(str string, quote func(string) string) string {
+		var result, missing = injectValues(str, variables, outputs, quote)
+		errors = append(errors, missing...)
+		return result
+	}
+
+	var quoteVars = pipeline.QuoteVars
+	if stage.QuoteVars != nil {
+		quoteVars = *stage.QuoteVars
+	}
+	var taskQuote func(string) string
+	if shell := ResolveShell(stage, pipeline); shell != "" && quoteVars {
+		taskQuote = func(value string) string { return ShellQuote(shell, value) }
+	}
+
+	stage.Task = inject(stage.Task, taskQuote)
+	stage.Pwd = inject(stage.Pwd, nil)
+	stage.Args = slices.Clone(stage.Args)
+	for i := range stage.Args {
+		stage.Args[i] = inject(stage.Args[i], nil)
+	}
+	stage.Env = slices.Clone(stage.Env)
+	for i := range stage.Env {
+		stage.Env[i] = inject(strings.TrimSpace(stage.Env[i]), nil)
+	}
+	stage.When = inject(stage.When, quoteWhenValue)
+
+	stage.Steps = slices.Clone(stage.Steps)
+	for i, step := range stage.Steps {
+		step.Task = inject(step.Task, taskQuote)
+		step.Args = slices.Clone(step.Args)
+		for j := range step.Args {
+			step.Args[j] = inject(step.Args[j], nil)
+		}
+		step.Env = slices.Clone(step.Env)
+		for j := range step.Env {
+			step.Env[j] = inject(strings.TrimSpace(step.Env[j]), nil)
+		}
+		stage.Steps[i] = step
+	}
+
+	stage.Variables = maps.Clone(stage.Variables)
+	for key, value := range stage.Variables {
+		stage.Variables[key] = inject(value, nil)
+	}
+
+	return stage, errors
 }
 
 func CreateVariableFile(variables map[string]string, logger *logrus.Logger) string {
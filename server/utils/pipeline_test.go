@@ -4,6 +4,7 @@ import (
 	"os"
 	"pipeline/data"
 	"testing"
+	"time"
 )
 
 var _ = os.Setenv("ENV", "test")
@@ -188,11 +189,13 @@ func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSuffic
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/root"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "node /root/media_central_index.js", pipeline.Stages[0].Task)
-	AssertStringEqual(t, "/root", pipeline.Stages[0].Pwd)
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "node /root/media_central_index.js", stage.Task)
+	AssertStringEqual(t, "/root", stage.Pwd)
 }
 
 func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSufficientForPwd(t *testing.T) {
@@ -202,10 +205,12 @@ func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSuffic
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/root"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "/root", pipeline.Stages[0].Pwd)
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "/root", stage.Pwd)
 }
 
 func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSufficientForArgs(t *testing.T) {
@@ -215,10 +220,12 @@ func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSuffic
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"action": "add"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "add", pipeline.Stages[0].Args[1])
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "add", stage.Args[1])
 }
 
 func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSufficientForEnv(t *testing.T) {
@@ -228,10 +235,12 @@ func Test_ValidatePipelineDefinition_ReturnsNoErrorsWhenPassedVariablesAreSuffic
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"ffmpeg_path": "/usr/bin"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "FFMPEG_PATH=/usr/bin", pipeline.Stages[0].Env[0])
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "FFMPEG_PATH=/usr/bin", stage.Env[0])
 }
 
 func Test_ValidatePipelineDefinition_ReturnsErrorWhenInvalidFormatForEnv(t *testing.T) {
@@ -268,15 +277,17 @@ func Test_ValidatePipelineDefinition_ShouldUsePassedVariablesInsteadOfVariableFi
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "node /home/root/Downloads/media_central_index.js", pipeline.Stages[0].Task)
-	AssertStringEqual(t, "/home/root/Downloads", pipeline.Stages[0].Pwd)
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "node /home/root/Downloads/media_central_index.js", stage.Task)
+	AssertStringEqual(t, "/home/root/Downloads", stage.Pwd)
 }
 
-// testing pass by reference
-func Test_ValidatePipelineDefinition_ReturnsPipelineWithInjectedVars(t *testing.T) {
+// the variables are kept on the pipeline, they are injected when each stage starts
+func Test_ValidatePipelineDefinition_LoadsVariablesForInjectionFromVariableFile(t *testing.T) {
 	// arrange
 	var pipeline = data.Pipeline{Name: "pipeline 1", Stages: []data.Stage{}, VariableFile: "../test_assets/test_var_file.txt"}
 	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage 1",
@@ -284,15 +295,17 @@ func Test_ValidatePipelineDefinition_ReturnsPipelineWithInjectedVars(t *testing.
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "node /home/root/Documents/media_central_index.js", pipeline.Stages[0].Task)
-	AssertStringEqual(t, "/home/root/Documents", pipeline.Stages[0].Pwd)
-	AssertStringEqual(t, "/home/root/Documents", pipeline.Stages[0].Args[0])
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "node /home/root/Documents/media_central_index.js", stage.Task)
+	AssertStringEqual(t, "/home/root/Documents", stage.Pwd)
+	AssertStringEqual(t, "/home/root/Documents", stage.Args[0])
 }
 
-func Test_ValidatePipelineDefinition_InjectsVariablesInAllStageFields(t *testing.T) {
+func Test_InjectStageVariables_InjectsVariablesInAllStageFields(t *testing.T) {
 	// arrange
 	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
 	pipeline.Stages = append(pipeline.Stages, data.Stage{
@@ -311,17 +324,19 @@ func Test_ValidatePipelineDefinition_InjectsVariablesInAllStageFields(t *testing
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "node app.js", pipeline.Stages[0].Task)
-	AssertStringEqual(t, "/home/user", pipeline.Stages[0].Pwd)
-	AssertStringEqual(t, "start", pipeline.Stages[0].Args[0])
-	AssertStringEqual(t, "production", pipeline.Stages[0].Args[1])
-	AssertStringEqual(t, "PATH=/usr/bin", pipeline.Stages[0].Env[0])
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "node app.js", stage.Task)
+	AssertStringEqual(t, "/home/user", stage.Pwd)
+	AssertStringEqual(t, "start", stage.Args[0])
+	AssertStringEqual(t, "production", stage.Args[1])
+	AssertStringEqual(t, "PATH=/usr/bin", stage.Env[0])
 }
 
-func Test_ValidatePipelineDefinition_HandlesCaseSensitiveVariables(t *testing.T) {
+func Test_InjectStageVariables_HandlesCaseSensitiveVariables(t *testing.T) {
 	// arrange
 	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
 	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage 1", Task: "echo {VAR} {var} {Var}"})
@@ -329,10 +344,12 @@ func Test_ValidatePipelineDefinition_HandlesCaseSensitiveVariables(t *testing.T)
 
 	// act
 	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
 
 	// assert
 	AssertEqual(t, 0, len(errors))
-	AssertStringEqual(t, "echo uppercase lowercase mixed", pipeline.Stages[0].Task)
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "echo uppercase lowercase mixed", stage.Task)
 }
 
 func Test_ValidatePipelineDefinition_ReturnsNoErrorsForValidPipelineWithMinimalData(t *testing.T) {
@@ -416,6 +433,608 @@ func Test_ValidatePipelineDefinition_ReturnsErrorForMultipleDependenciesIncludin
 	AssertContains(t, errors, "deploy (2) listed self as dependency")
 }
 
+func Test_ValidatePipelineDefinition_AllowsDependencyOnStageDefinedLater(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "deploy", Task: "npm run deploy", DependsOn: []string{"build", "test"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "test", Task: "npm test", DependsOn: []string{"build"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "build", Task: "npm run build"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorWithPathForDependencyCycle(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "a", Task: "echo", DependsOn: []string{"b"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "b", Task: "echo", DependsOn: []string{"c"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "c", Task: "echo", DependsOn: []string{"a"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "d", Task: "echo", DependsOn: []string{"a"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "Dependency cycle detected: a -> b -> c -> a")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorForEachSeparateDependencyCycle(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "build", Task: "echo", DependsOn: []string{"test"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "test", Task: "echo", DependsOn: []string{"build"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "lint", Task: "echo", DependsOn: []string{"format"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "format", Task: "echo", DependsOn: []string{"lint", "build"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 2, len(errors))
+	AssertContains(t, errors, "Dependency cycle detected: build -> test -> build")
+	AssertContains(t, errors, "Dependency cycle detected: lint -> format -> lint")
+}
+
+func Test_ValidatePipelineDefinition_DoesNotReportSelfDependencyAsCycle(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", DependsOn: []string{"stage1", "stage2"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "stage1 (0) listed self as dependency")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorForInvalidStageTimeout(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", Timeout: "10 minutes"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo", Timeout: "-5s"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 2, len(errors))
+	AssertContains(t, errors, "stage1 (0) invalid timeout '10 minutes'")
+	AssertContains(t, errors, "stage2 (1) invalid timeout '-5s'")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorForInvalidPipelineTimeout(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Timeout: "1 hour", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "Invalid pipeline timeout: '1 hour'")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsNoErrorsForValidTimeouts(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Timeout: "1h30m", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", Timeout: "90s"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidRetryPolicy(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", Retry: &data.RetryPolicy{MaxAttempts: 0, Backoff: "linear", Delay: "soon", MaxDelay: "-1s"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 4, len(errors))
+	AssertContains(t, errors, "stage1 (0) retry max_attempts must be at least 1")
+	AssertContains(t, errors, "stage1 (0) invalid retry backoff 'linear', expected 'fixed' or 'exponential'")
+	AssertContains(t, errors, "stage1 (0) invalid retry delay 'soon'")
+	AssertContains(t, errors, "stage1 (0) invalid retry max_delay '-1s'")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsNoErrorsForValidRetryPolicy(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", Retry: &data.RetryPolicy{MaxAttempts: 3}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo", Retry: &data.RetryPolicy{MaxAttempts: 5, Backoff: "exponential", Delay: "5s", MaxDelay: "1m", Jitter: true, ExitCodes: []int{1, 75}}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorForNegativeMaxParallel(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Parallel: true, MaxParallel: -1, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, nil, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "Invalid pipeline max_parallel: -1, must be 0 (default) or more")
+}
+
+func Test_InjectStageVariables_QuotesInjectedTaskVariablesWhenRunThroughShell(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Shell: "bash", QuoteVars: true, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "ls {dir} | wc -l", Pwd: "{dir}"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "node", Args: []string{"{dir}"}, Shell: "none"})
+	var variables = map[string]string{"dir": "/home/my media; rm -rf /"}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage1, _ = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
+	var stage2, _ = InjectStageVariables(pipeline.Stages[1], &pipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertStringEqual(t, "ls '/home/my media; rm -rf /' | wc -l", stage1.Task)
+	AssertStringEqual(t, "/home/my media; rm -rf /", stage1.Pwd) // not parsed by the shell, so not quoted
+	AssertStringEqual(t, "/home/my media; rm -rf /", stage2.Args[0])
+}
+
+func Test_InjectStageVariables_LetsStageQuoteVariablesOverridePipelineQuoteVariables(t *testing.T) {
+	// arrange
+	var quote, noQuote = true, false
+	var pipeline = data.Pipeline{Name: "test", Shell: "bash", QuoteVars: true, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "ls {dir}", QuoteVars: &noQuote})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "ls {dir}"})
+	var quotingPipeline = data.Pipeline{Name: "test", Shell: "bash", Stages: []data.Stage{{Name: "stage1", Task: "ls {dir}", QuoteVars: &quote}}}
+	var variables = map[string]string{"dir": "/home/media/*.mkv"}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	errors = append(errors, ValidatePipelineDefinition(&quotingPipeline, &variables, testLogger)...)
+	var stage1, _ = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
+	var stage2, _ = InjectStageVariables(pipeline.Stages[1], &pipeline, nil)
+	var quotingStage, _ = InjectStageVariables(quotingPipeline.Stages[0], &quotingPipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertStringEqual(t, "ls /home/media/*.mkv", stage1.Task)
+	AssertStringEqual(t, "ls '/home/media/*.mkv'", stage2.Task)
+	AssertStringEqual(t, "ls '/home/media/*.mkv'", quotingStage.Task)
+}
+
+func Test_InjectStageVariables_DoesNotQuoteInjectedTaskVariablesByDefault(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Shell: "bash", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "ls {dir}"})
+	var variables = map[string]string{"dir": "/home/media"}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "ls /home/media", stage.Task)
+}
+
+func Test_ResolveEnv_InjectsVariablesInPipelineEnv(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Env: map[string]string{"MEDIA_ROOT": "{root}/media"}, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/mnt/nas"}, testLogger)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertStringEqual(t, "{root}/media", pipeline.Env["MEDIA_ROOT"]) // the definition is left as is
+	AssertContains(t, ResolveEnv(pipeline.Stages[0], &pipeline), "MEDIA_ROOT=/mnt/nas/media")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidPipelineEnvAndInheritEnv(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Env: map[string]string{"MEDIA_ROOT": "{root}"}, InheritEnv: data.InheritEnv{"PATH", "all"}, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 2, len(errors))
+	AssertContains(t, errors, "Missing variable: root")
+	AssertContains(t, errors, "Invalid pipeline inherit_env: 'all' and 'none' can't be part of a list of env var names")
+}
+
+func Test_InjectStageVariables_InjectsVariablesInWhenConditionAsStrings(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo", DependsOn: []string{"stage1"},
+		When: "stages.stage1.status == 'success' && {mode} == 'full run'"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"mode": "full run"}, testLogger)
+	var stage, _ = InjectStageVariables(pipeline.Stages[1], &pipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertStringEqual(t, "stages.stage1.status == 'success' && 'full run' == 'full run'", stage.When)
+}
+
+func Test_ValidatePipelineDefinition_AcceptsWhenConditionsReferencingDependenciesWithoutThePrefix(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcribe", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "summarize", Task: "echo", DependsOn: []string{"transcribe"},
+		When: "transcribe.status == 'success' && {mode} == 'full'"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "publish", Task: "echo", When: "transcribe.status == 'success'"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"mode": "full"}, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "publish (2) invalid when condition: invalid stage reference 'transcribe.status', 'transcribe' must be listed in depends_on")
+}
+
+func Test_InjectStageVariables_InjectsOutputsOfOtherStages(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Shell: "bash", QuoteVars: true, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "discover", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcode", Task: "transcode {stages.discover.files}",
+		DependsOn: []string{"discover"}, Pwd: "{root}/{stages.discover.dir}", Args: []string{"--count={stages.discover.new_count}"},
+		Env: []string{"NEW_COUNT={stages.discover.new_count}"}, When: "{stages.discover.new_count} != '0'"})
+	var outputs = map[string]map[string]string{"discover": {"new_count": "3", "dir": "incoming", "files": "a b.mkv"}}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/mnt/nas"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[1], &pipeline, outputs)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "transcode 'a b.mkv'", stage.Task)
+	AssertStringEqual(t, "/mnt/nas/incoming", stage.Pwd)
+	AssertStringEqual(t, "--count=3", stage.Args[0])
+	AssertStringEqual(t, "NEW_COUNT=3", stage.Env[0])
+	AssertStringEqual(t, "'3' != '0'", stage.When)
+	AssertStringEqual(t, "--count={stages.discover.new_count}", pipeline.Stages[1].Args[0]) // the definition is left as is
+}
+
+func Test_InjectStageVariables_InjectsVariablesPassedToPipelineStages(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "nightly", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "backup", Task: "backup"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Pipeline: "index", DependsOn: []string{"backup"},
+		Variables: map[string]string{"root": "{root}/media", "since": "{stages.backup.finished_at}"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/srv"}, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[1], &pipeline,
+		map[string]map[string]string{"backup": {"finished_at": "2026-10-17"}})
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertEqual(t, 0, len(injectErrors))
+	AssertMapEqual(t, map[string]string{"root": "/srv/media", "since": "2026-10-17"}, stage.Variables)
+	AssertStringEqual(t, "{root}/media", pipeline.Stages[1].Variables["root"]) // the definition isn't changed
+}
+
+func Test_InjectStageVariables_ReturnsErrorsForMissingOutputs(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "discover", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcode", Task: "transcode",
+		DependsOn: []string{"discover"}, Args: []string{"{stages.discover.new_count}", "{stages.discover.dir}"}})
+	var outputs = map[string]map[string]string{"discover": {"dir": "incoming"}}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+	var _, injectErrors = InjectStageVariables(pipeline.Stages[1], &pipeline, outputs)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertEqual(t, 1, len(injectErrors))
+	AssertContains(t, injectErrors, "Missing output: stages.discover.new_count")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForOutputsOfStagesNotDependedOn(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Env: map[string]string{"COUNT": "{stages.discover.new_count}"}, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "discover", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcode", Task: "transcode {stages.discover.files}",
+		Env: []string{"COUNT={stages.discover.new_count}"}, When: "{stages.discover.new_count} != '0'"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 4, len(errors))
+	AssertContains(t, errors, "Invalid pipeline env 'COUNT': stage outputs can only be used in a stage's env")
+	AssertContains(t, errors, "transcode (1) uses outputs of 'discover', which must be listed in depends_on")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidArtifacts(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "build/linux", Task: "make", Artifacts: []string{"dist/*", "../secrets", "/etc/passwd", "out/[a-"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "lint", Task: "lint"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "deploy", Task: "deploy", DependsOn: []string{"lint"},
+		NeedsArtifacts: []string{"build/linux", "lint"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 6, len(errors))
+	AssertContains(t, errors, "build/linux (0) invalid artifacts pattern '../secrets', must be a glob relative to the stage's pwd")
+	AssertContains(t, errors, "build/linux (0) invalid artifacts pattern '/etc/passwd', must be a glob relative to the stage's pwd")
+	AssertContains(t, errors, "build/linux (0) invalid artifacts pattern 'out/[a-', must be a glob relative to the stage's pwd")
+	AssertContains(t, errors, "build/linux (0) has artifacts, its name can't contain '/' or '\\', or be '.' or '..'")
+	AssertContains(t, errors, "deploy (2) needs artifacts of 'build/linux', which must be listed in depends_on")
+	AssertContains(t, errors, "deploy (2) needs artifacts of 'lint', which doesn't declare any")
+}
+
+func Test_ValidatePipelineDefinition_ShouldAcceptMatrixKeysAsVariablesOfTheStage(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcribe", Task: "transcribe --lang {lang}", Pwd: "{root}",
+		Matrix: map[string][]string{"lang": {"en", "es"}}, MaxParallel: 1})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "publish", Task: "publish {lang}", DependsOn: []string{"transcribe"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/media"}, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "Missing variable: lang") // only the matrix stage gets the matrix values
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorForOutputsOfMatrixStages(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcribe", Task: "transcribe --lang {lang}",
+		Matrix: map[string][]string{"lang": {"en", "es"}}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "publish", Task: "publish {stages.transcribe.subtitles}",
+		DependsOn: []string{"transcribe"}, When: "{stages.transcribe.subtitles} != ''"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 2, len(errors))
+	AssertContains(t, errors, "publish (1) uses outputs of 'transcribe', a matrix stage's outputs can't be used by name as each of its instances has its own")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidMatrix(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcribe", Task: "transcribe", Artifacts: []string{"*.srt"}, MaxParallel: -1,
+		Matrix: map[string][]string{"lang-code": {"en"}, "model": {}, "dir": {"a/b"}}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 4, len(errors))
+	AssertContains(t, errors, "transcribe (0) invalid max_parallel: -1, must be 0 (no limit) or more")
+	AssertContains(t, errors, "transcribe (0) invalid matrix key 'lang-code', must only contain letters, digits and _")
+	AssertContains(t, errors, "transcribe (0) matrix key 'model' has no values")
+	AssertContains(t, errors, "transcribe (0) has artifacts, its matrix value 'a/b' can't contain '/' or '\\'")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidSteps(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "build", Task: "make", Steps: []data.Step{{Task: "make test"}}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "package", Steps: []data.Step{
+		{Name: "zip", Task: "zip {target}"},
+		{Name: "sign", Args: []string{"{key}"}, Env: []string{"NOEQUALS"}}}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"target": "app"}, testLogger)
+
+	// assert
+	AssertEqual(t, 4, len(errors))
+	AssertContains(t, errors, "build (0) has both task and steps, only one can be set")
+	AssertContains(t, errors, "package (1) step 2 task is missing")
+	AssertContains(t, errors, "Missing variable: key")
+	AssertContains(t, errors, "invalid env format: 'NOEQUALS'")
+}
+
+func Test_InjectStageVariables_InjectsVariablesInSteps(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "build", Steps: []data.Step{
+		{Name: "compile", Task: "go build {target}", Args: []string{"-o", "{out}"}, Env: []string{"GOOS={os}"}},
+		{Task: "strip {out}"}}})
+
+	var variables = map[string]string{"target": "./cmd", "out": "bin/app", "os": "linux"}
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &variables, testLogger)
+	var stage, injectErrors = InjectStageVariables(pipeline.Stages[0], &pipeline, nil)
+
+	// assert
+	AssertEqual(t, 0, len(errors))
+	AssertEqual(t, 0, len(injectErrors))
+	AssertStringEqual(t, "go build ./cmd", stage.Steps[0].Task)
+	AssertSliceEqual(t, []string{"-o", "bin/app"}, stage.Steps[0].Args)
+	AssertSliceEqual(t, []string{"GOOS=linux"}, stage.Steps[0].Env)
+	AssertStringEqual(t, "strip bin/app", stage.Steps[1].Task)
+	AssertStringEqual(t, "go build {target}", pipeline.Stages[0].Steps[0].Task) // the definition isn't changed
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidPipelineStages(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "nightly", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "backup", Pipeline: "backup", Variables: map[string]string{"target": "{root}/media"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Pipeline: "index", Task: "index",
+		Variables: map[string]string{"batch-size": "{size}", "since": "{stages.backup.finished_at}"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "again", Pipeline: "nightly"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "report", Task: "report", Variables: map[string]string{"format": "html"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"root": "/srv"}, testLogger)
+
+	// assert
+	AssertEqual(t, 6, len(errors))
+	AssertContains(t, errors, "index (1) has a pipeline to run, it can't have a task or steps too")
+	AssertContains(t, errors, "index (1) invalid variable name 'batch-size', must only contain letters, digits and _")
+	AssertContains(t, errors, "Missing variable: size")
+	AssertContains(t, errors, "index (1) uses outputs of 'backup', which must be listed in depends_on")
+	AssertContains(t, errors, "again (2) can't run the pipeline it's part of ('nightly')")
+	AssertContains(t, errors, "report (3) has variables, but no pipeline to pass them to")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForEmptyLockNames(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "import", Task: "import", Locks: []string{"media-db", " "}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "scan", Task: "scan", Locks: []string{"gpu-disk", "media-db"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 1, len(errors))
+	AssertContains(t, errors, "import (0) has an empty lock name")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidLimits(t *testing.T) {
+	// arrange
+	var level8, level2 = 8, 2
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "train", Task: "train", Limits: &data.ProcessLimits{CpuTime: "2h", MemoryMB: 8000, Nice: 10, IOClass: "idle"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "render", Task: "render", Limits: &data.ProcessLimits{CpuTime: "forever", OpenFiles: -1, Nice: 20}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Task: "index", Limits: &data.ProcessLimits{IOClass: "fast", IOLevel: &level8}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "scan", Task: "scan", Limits: &data.ProcessLimits{IOLevel: &level2}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "deploy", Pipeline: "deploy", Limits: &data.ProcessLimits{MemoryMB: 100}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 7, len(errors))
+	AssertContains(t, errors, "render (1) invalid cpu_time limit 'forever'")
+	AssertContains(t, errors, "render (1) invalid open_files limit: -1, must be 0 (not limited) or more")
+	AssertContains(t, errors, "render (1) invalid nice level: 20, must be from -20 to 19")
+	AssertContains(t, errors, "index (2) invalid io_class 'fast', expected 'realtime', 'best-effort' or 'idle'")
+	AssertContains(t, errors, "index (2) invalid io_level: 8, must be from 0 to 7")
+	AssertContains(t, errors, "scan (3) io_level needs an io_class, it is the priority within the class")
+	AssertContains(t, errors, "deploy (4) runs a pipeline, limits go on its stages, not the stage itself")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidExecutors(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}, Executor: "builder", Executors: map[string]data.Executor{
+		"nas":     {Type: "ssh", Host: "nas.local", User: "media"},
+		"local":   {Type: "ssh", Host: "localhost"},
+		"broken":  {Type: "telnet", Port: 70000},
+		"nowhere": {Type: "ssh"},
+	}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "import", Task: "import", Executor: "nas"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "plan", Task: "plan", Executor: "dry-run"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "scan", Task: "scan", Executor: "gpu-box"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Task: "index", Executor: "nas", Limits: &data.ProcessLimits{Nice: 10}, Artifacts: []string{"index.db"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "deploy", Pipeline: "deploy", Executor: "nas"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 9, len(errors))
+	AssertContains(t, errors, "Invalid executor 'local': the name is taken by a built in executor")
+	AssertContains(t, errors, "Invalid executor 'broken': type 'telnet', expected 'local', 'ssh' or 'dry-run'")
+	AssertContains(t, errors, "Invalid executor 'broken': port 70000, must be from 1 to 65535 (default 22)")
+	AssertContains(t, errors, "Invalid executor 'nowhere': ssh needs a host to connect to")
+	AssertContains(t, errors, "Invalid pipeline executor 'builder', it isn't a built in executor or one of the pipeline's executors")
+	AssertContains(t, errors, "scan (2) unknown executor 'gpu-box', it isn't a built in executor or one of the pipeline's executors")
+	AssertContains(t, errors, "index (3) runs on another host, limits can only be applied to the server's processes")
+	AssertContains(t, errors, "index (3) runs on another host, only stages run on the server can keep or need artifacts")
+	AssertContains(t, errors, "deploy (4) runs a pipeline, executors go on its stages, not the stage itself")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidRunsOn(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}, Executors: map[string]data.Executor{"nas": {Type: "ssh", Host: "nas.local"}}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "train", Task: "train", RunsOn: []string{"gpu", "linux"}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "scan", Task: "scan", RunsOn: []string{"gpu", " "}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "import", Task: "import", RunsOn: []string{"nas"}, Executor: "nas"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Task: "index", RunsOn: []string{"nas"}, Limits: &data.ProcessLimits{Nice: 10}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "deploy", Pipeline: "deploy", RunsOn: []string{"linux"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 4, len(errors))
+	AssertContains(t, errors, "scan (1) has an empty runs_on label")
+	AssertContains(t, errors, "import (2) has both runs_on and executor, only one can be set")
+	AssertContains(t, errors, "index (3) runs on another host, limits can only be applied to the server's processes")
+	AssertContains(t, errors, "deploy (4) runs a pipeline, executors go on its stages, not the stage itself")
+}
+
+func Test_CpuTimeLimit_RoundsUpToWholeSeconds(t *testing.T) {
+	// act & assert
+	AssertTrue(t, CpuTimeLimit(data.ProcessLimits{}) == 0)
+	AssertTrue(t, CpuTimeLimit(data.ProcessLimits{CpuTime: "1m"}) == time.Minute)
+	AssertTrue(t, CpuTimeLimit(data.ProcessLimits{CpuTime: "1500ms"}) == 2*time.Second)
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidWhenConditions(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo", When: "stages.stage1.status == 'success'"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage3", Task: "echo", When: "({mode} == 'full'"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage4", Task: "echo", When: "{missing} == 'x'"})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{"mode": "full"}, testLogger)
+
+	// assert
+	AssertEqual(t, 3, len(errors))
+	AssertContains(t, errors, "stage2 (1) when condition references 'stage1', which must be listed in depends_on")
+	AssertContains(t, errors, "stage3 (2) invalid when condition: missing ')'")
+	AssertContains(t, errors, "Missing variable: missing")
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForInvalidRunOn(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Name: "test", Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage1", Task: "echo", RunOn: "always"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage2", Task: "echo", RunOn: "sometimes"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage3", Task: "echo", RunOn: "failure"})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "stage4", Task: "echo", RunOn: "failure", DependsOn: []string{"stage1"}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 2, len(errors))
+	AssertContains(t, errors, "stage2 (1) invalid run_on 'sometimes', expected 'success', 'failure' or 'always'")
+	AssertContains(t, errors, "stage3 (2) run_on 'failure' needs depends_on, it runs when one of them fails")
+}
+
 func Test_validateVars_ReturnsErrorForNonExistentVariable(t *testing.T) {
 	// arrange
 	var variables = map[string]string{"varKey": "varValue"}
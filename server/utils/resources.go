@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Stages can say how much of a resource they need while they run e.g. {"cpu": 4, "memory_mb": 8000}, and a pipeline
+// (or the server, with the RESOURCE_CAPACITY env var) how much of each it has. The stages running at once never
+// need more than the capacity, a resource without one is unlimited.
+
+// ParseCapacity parses a list of resources and amounts like "cpu=16,memory_mb=32000"
+func ParseCapacity(value string) (map[string]int, error) {
+	var capacity = make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, amount, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || !NameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid entry '%s', expected name=amount", strings.TrimSpace(entry))
+		}
+
+		number, err := strconv.Atoi(strings.TrimSpace(amount))
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid amount of %s: '%s', must be more than 0", name, strings.TrimSpace(amount))
+		}
+		capacity[name] = number
+	}
+	return capacity, nil
+}
+
+// ServerCapacity returns the capacity set with the RESOURCE_CAPACITY env var, which every run shares. It is ignored
+// if it isn't valid
+func ServerCapacity(logger *logrus.Logger) map[string]int {
+	if os.Getenv("RESOURCE_CAPACITY") == "" {
+		return nil
+	}
+
+	capacity, err := ParseCapacity(os.Getenv("RESOURCE_CAPACITY"))
+	if err != nil {
+		logger.Warn("Ignoring invalid RESOURCE_CAPACITY environment variable: " + err.Error())
+		return nil
+	}
+	return capacity
+}
+
+// FitsCapacity reports whether a stage needing resources can start while inUse is taken, without going over capacity
+func FitsCapacity(resources map[string]int, inUse map[string]int, capacity map[string]int) bool {
+	for name, amount := range resources {
+		if limit, limited := capacity[name]; limited && inUse[name]+amount > limit {
+			return false
+		}
+	}
+	return true
+}
+
+func validateResources(resources map[string]int, pipelineCapacity map[string]int, serverCapacity map[string]int, stageLabel string,
+	logger *logrus.Logger) []string {
+	var errors []string
+
+	for name, amount := range resources {
+		if !NameRegex.MatchString(name) {
+			logger.Error(stageLabel + " has an invalid resource name: " + name)
+			errors = append(errors, stageLabel+" invalid resource name '"+name+"', must only contain letters, digits and _")
+		}
+		if amount < 0 {
+			logger.Error(stageLabel + " needs a negative amount of " + name)
+			errors = append(errors, stageLabel+" invalid amount of "+name+": "+strconv.Itoa(amount)+", must be 0 or more")
+		}
+
+		// a stage that needs more than there is would never start
+		if limit, limited := pipelineCapacity[name]; limited && amount > limit {
+			logger.Error(stageLabel + " needs more " + name + " than the pipeline's capacity")
+			errors = append(errors, stageLabel+" needs "+strconv.Itoa(amount)+" "+name+", more than the pipeline's capacity of "+strconv.Itoa(limit))
+		}
+		if limit, limited := serverCapacity[name]; limited && amount > limit {
+			logger.Error(stageLabel + " needs more " + name + " than the server's capacity")
+			errors = append(errors, stageLabel+" needs "+strconv.Itoa(amount)+" "+name+", more than the server's capacity of "+strconv.Itoa(limit))
+		}
+	}
+
+	return errors
+}
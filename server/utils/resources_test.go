@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"pipeline/data"
+	"testing"
+)
+
+func Test_ParseCapacity_ShouldParseResourcesAndAmounts(t *testing.T) {
+	// act
+	var capacity, err = ParseCapacity("cpu=16, memory_mb = 32000,")
+
+	// assert
+	AssertTrue(t, err == nil)
+	AssertEqual(t, 2, len(capacity))
+	AssertEqual(t, 16, capacity["cpu"])
+	AssertEqual(t, 32000, capacity["memory_mb"])
+}
+
+func Test_ParseCapacity_ShouldReturnErrorForInvalidEntries(t *testing.T) {
+	// act
+	var _, missingAmount = ParseCapacity("cpu")
+	var _, zeroAmount = ParseCapacity("cpu=0")
+	var _, invalidName = ParseCapacity("memory-mb=100")
+
+	// assert
+	AssertStringEqual(t, "invalid entry 'cpu', expected name=amount", missingAmount.Error())
+	AssertStringEqual(t, "invalid amount of cpu: '0', must be more than 0", zeroAmount.Error())
+	AssertStringEqual(t, "invalid entry 'memory-mb=100', expected name=amount", invalidName.Error())
+}
+
+func Test_ServerCapacity_ShouldIgnoreInvalidEnvVar(t *testing.T) {
+	// arrange
+	t.Setenv("RESOURCE_CAPACITY", "cpu=lots")
+
+	// act
+	var capacity = ServerCapacity(testLogger)
+
+	// assert
+	AssertEqual(t, 0, len(capacity))
+}
+
+func Test_FitsCapacity_ShouldOnlyLimitResourcesWithACapacity(t *testing.T) {
+	// arrange
+	var capacity = map[string]int{"cpu": 8}
+	var inUse = map[string]int{"cpu": 6, "memory_mb": 64000}
+
+	// act
+	var fits = FitsCapacity(map[string]int{"cpu": 2, "memory_mb": 8000}, inUse, capacity)
+	var tooBig = FitsCapacity(map[string]int{"cpu": 3}, inUse, capacity)
+	var nothing = FitsCapacity(nil, inUse, capacity)
+
+	// assert
+	AssertTrue(t, fits)
+	AssertFalse(t, tooBig)
+	AssertTrue(t, nothing)
+}
+
+func Test_ValidatePipelineDefinition_ReturnsErrorsForStagesThatCanNeverFit(t *testing.T) {
+	// arrange
+	t.Setenv("RESOURCE_CAPACITY", "gpu=1")
+	var pipeline = data.Pipeline{Name: "test", Capacity: map[string]int{"cpu": 4, "disk-io": 0}, Stages: []data.Stage{}}
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "transcribe", Task: "transcribe", Resources: map[string]int{"cpu": 8, "gpu": 2}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "tag", Task: "tag", Resources: map[string]int{"cpu": 1, "memory_mb": -1}})
+	pipeline.Stages = append(pipeline.Stages, data.Stage{Name: "index", Pipeline: "index", Resources: map[string]int{"cpu": 1}})
+
+	// act
+	var errors = ValidatePipelineDefinition(&pipeline, &map[string]string{}, testLogger)
+
+	// assert
+	AssertEqual(t, 5, len(errors))
+	AssertContains(t, errors, "Invalid pipeline capacity 'disk-io': 0, the name must only contain letters, digits and _ and the amount be more than 0")
+	AssertContains(t, errors, "transcribe (0) needs 8 cpu, more than the pipeline's capacity of 4")
+	AssertContains(t, errors, "transcribe (0) needs 2 gpu, more than the server's capacity of 1")
+	AssertContains(t, errors, "tag (1) invalid amount of memory_mb: -1, must be 0 or more")
+	AssertContains(t, errors, "index (2) runs a pipeline, its stages need resources, not the stage itself")
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"path/filepath"
+	"pipeline/data"
+	"strings"
+)
+
+// ResolveShell returns the shell a stage's task should be run through, a stage's own shell overrides the pipeline's.
+// An empty string means the task is run directly as an executable (a stage can use "none" to opt out of the pipeline's shell).
+func ResolveShell(stage data.Stage, pipeline *data.Pipeline) string {
+	var shell = stage.Shell
+	if shell == "" && pipeline != nil {
+		shell = pipeline.Shell
+	}
+	if shell == "none" {
+		return ""
+	}
+	return shell
+}
+
+func shellName(shell string) string {
+	return strings.TrimSuffix(strings.ToLower(filepath.Base(shell)), ".exe")
+}
+
+// ShellFlag returns the flag a shell takes to run a command string, e.g. "-c" for bash and sh.
+func ShellFlag(shell string) string {
+	switch shellName(shell) {
+	case "cmd":
+		return "/C"
+	case "powershell", "pwsh":
+		return "-Command"
+	default:
+		return "-c"
+	}
+}
+
+// IsCmd reports whether shell is windows' cmd, which parses its own command line instead of getting its args split
+func IsCmd(shell string) bool {
+	return shellName(shell) == "cmd"
+}
+
+// ShellQuote quotes a value so the shell treats it as a single literal word, no matter what characters it contains.
+func ShellQuote(shell string, value string) string {
+	switch shellName(shell) {
+	case "cmd":
+		// cmd has no real escaping, double quotes are the best there is
+		return "\"" + strings.ReplaceAll(value, "\"", "\"\"") + "\""
+	case "powershell", "pwsh":
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	default:
+		return "'" + strings.ReplaceAll(value, "'", "'\\''") + "'"
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"pipeline/data"
+	"testing"
+)
+
+func Test_ResolveShell_ShouldPreferStageShellOverPipelineShell(t *testing.T) {
+	// arrange
+	var pipeline = data.Pipeline{Shell: "bash"}
+
+	// act & assert
+	AssertStringEqual(t, "bash", ResolveShell(data.Stage{}, &pipeline))
+	AssertStringEqual(t, "sh", ResolveShell(data.Stage{Shell: "sh"}, &pipeline))
+	AssertStringEqual(t, "", ResolveShell(data.Stage{Shell: "none"}, &pipeline))
+	AssertStringEqual(t, "", ResolveShell(data.Stage{}, &data.Pipeline{}))
+}
+
+func Test_ShellFlag_ShouldReturnFlagForEachShell(t *testing.T) {
+	// act & assert
+	AssertStringEqual(t, "-c", ShellFlag("bash"))
+	AssertStringEqual(t, "-c", ShellFlag("/bin/sh"))
+	AssertStringEqual(t, "/C", ShellFlag("cmd.exe"))
+	AssertStringEqual(t, "-Command", ShellFlag("powershell"))
+	AssertStringEqual(t, "-Command", ShellFlag("pwsh"))
+}
+
+func Test_ShellQuote_ShouldQuoteValuesAsSingleLiteralWord(t *testing.T) {
+	// act & assert
+	AssertStringEqual(t, "'hello world'", ShellQuote("bash", "hello world"))
+	AssertStringEqual(t, "'it'\\''s; rm -rf /'", ShellQuote("sh", "it's; rm -rf /"))
+	AssertStringEqual(t, "'$HOME'", ShellQuote("bash", "$HOME"))
+	AssertStringEqual(t, "'it''s'", ShellQuote("powershell", "it's"))
+	AssertStringEqual(t, "\"say \"\"hi\"\"\"", ShellQuote("cmd", "say \"hi\""))
+}
@@ -194,6 +194,35 @@ func InitDir(dir string, logger *logrus.Logger) bool {
 	return true
 }
 
+// CopyFile copies the contents and permissions of src to dst, creating any directories dst needs
+func CopyFile(src string, dst string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	destination, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
+
 func DeleteFile(filename string, logger *logrus.Logger) bool {
 	if filename != "" {
 		err := os.Remove(filename)
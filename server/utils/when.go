@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"fmt"
+	"pipeline/data"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A stage's `when` condition is a small boolean expression, e.g. "stages.transcribe.status == 'success' && {mode} == 'full'"
+//
+//	expression - condition (("&&" | "||") condition)*, && binds tighter than ||
+//	condition  - "!" condition | "(" expression ")" | operand (("==" | "!=") operand)?
+//	operand    - 'quoted' or "quoted" string, {env.NAME}, stages.NAME.status, stages.NAME.exit_code, or a bare word like
+//	             true, 3 or v1.2. The stages. prefix can be left out for the stages the stage depends on e.g. build.status
+//
+// Pipeline variables ({mode}) and outputs of other stages ({stages.NAME.KEY}) are injected as quoted strings just
+// before the stage would run, env values and the outcomes of other stages are looked up when it is evaluated.
+// An operand on its own is true unless it is empty, "false" or "0". A stage's status can be compared to one
+// of data.StageStatus, or to 'success' (succeeded) or 'failure' (anything that failed, even if it was allowed to).
+
+type whenToken struct {
+	kind  string // one of ( ) ! && || == != string env word
+	value string
+}
+
+type whenOperand struct {
+	value    string
+	isStatus bool // the status of a stage, which can be compared to 'success' or 'failure'
+}
+
+type whenParser struct {
+	tokens    []whenToken
+	pos       int
+	dependsOn []string // the stages that can be referenced without the stages. prefix
+	stages    map[string]data.TaskStatusResponse
+	env       map[string]string
+	refs      []string // the stages referenced, in order of appearance
+}
+
+// ParseWhen checks the syntax of the when condition of a stage that depends on dependsOn, and returns the names of
+// the stages it references
+func ParseWhen(expression string, dependsOn []string) ([]string, error) {
+	parser, err := newWhenParser(expression, dependsOn, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = parser.parse(); err != nil {
+		return nil, err
+	}
+	return parser.refs, nil
+}
+
+// EvaluateWhen works out if the when condition of a stage that depends on dependsOn holds, given the stages that have
+// finished and the stage's env
+func EvaluateWhen(expression string, dependsOn []string, stages map[string]data.TaskStatusResponse, env []string) (bool, error) {
+	var envValues = make(map[string]string, len(env))
+	for _, entry := range env {
+		if key, value, found := strings.Cut(entry, "="); found {
+			envValues[key] = value // later entries override earlier ones, same as the process would see
+		}
+	}
+
+	parser, err := newWhenParser(expression, dependsOn, stages, envValues)
+	if err != nil {
+		return false, err
+	}
+	return parser.parse()
+}
+
+// variables and outputs are injected into a when condition as quoted strings, so values with spaces or
+// operators in them are compared as they are
+func quoteWhenValue(value string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func newWhenParser(expression string, dependsOn []string, stages map[string]data.TaskStatusResponse, env map[string]string) (*whenParser, error) {
+	tokens, err := tokenizeWhen(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("condition is empty")
+	}
+
+	return &whenParser{tokens: tokens, dependsOn: dependsOn, stages: stages, env: env}, nil
+}
+
+func tokenizeWhen(expression string) ([]whenToken, error) {
+	var tokens []whenToken
+	for i := 0; i < len(expression); {
+		var c = expression[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, whenToken{kind: string(c)})
+			i++
+		case strings.HasPrefix(expression[i:], "&&") || strings.HasPrefix(expression[i:], "||") ||
+			strings.HasPrefix(expression[i:], "==") || strings.HasPrefix(expression[i:], "!="):
+			tokens = append(tokens, whenToken{kind: expression[i : i+2]})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, whenToken{kind: "!"})
+			i++
+		case c == '\'' || c == '"':
+			var value strings.Builder
+			var closed = false
+			j := i + 1
+			for ; j < len(expression); j++ {
+				if expression[j] == '\\' && j+1 < len(expression) {
+					j++
+					value.WriteByte(expression[j])
+				} else if expression[j] == c {
+					closed = true
+					break
+				} else {
+					value.WriteByte(expression[j])
+				}
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string starting at position %d", i)
+			}
+			tokens = append(tokens, whenToken{kind: "string", value: value.String()})
+			i = j + 1
+		case c == '{':
+			end := strings.IndexByte(expression[i:], '}')
+			if end == -1 || !strings.HasPrefix(expression[i:], "{env.") || end == len("{env.") {
+				return nil, fmt.Errorf("invalid reference at position %d, expected {env.NAME}", i)
+			}
+			tokens = append(tokens, whenToken{kind: "env", value: expression[i+len("{env.") : i+end]})
+			i += end + 1
+		case isWhenWordChar(c):
+			j := i
+			for j < len(expression) && isWhenWordChar(expression[j]) {
+				j++
+			}
+			tokens = append(tokens, whenToken{kind: "word", value: expression[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at position %d", c, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isWhenWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+func (p *whenParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *whenParser) parse() (bool, error) {
+	result, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, fmt.Errorf("unexpected '%s'", p.describe(p.tokens[p.pos]))
+	}
+	return result, nil
+}
+
+// both sides are always parsed (no short circuiting), so every error and reference is found
+func (p *whenParser) parseOr() (bool, error) {
+	result, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var right bool
+		right, err = p.parseAnd()
+		result = result || right
+	}
+	return result, err
+}
+
+func (p *whenParser) parseAnd() (bool, error) {
+	result, err := p.parseCondition()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var right bool
+		right, err = p.parseCondition()
+		result = result && right
+	}
+	return result, err
+}
+
+func (p *whenParser) parseCondition() (bool, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		result, err := p.parseCondition()
+		return !result, err
+	case "(":
+		p.pos++
+		result, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if p.peek() != ")" {
+			return false, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return result, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return false, err
+	}
+
+	var operator = p.peek()
+	if operator != "==" && operator != "!=" {
+		return left.value != "" && left.value != "false" && left.value != "0", nil
+	}
+	p.pos++
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return false, err
+	}
+
+	var equal = whenEqual(left, right) || whenEqual(right, left)
+	if operator == "!=" {
+		return !equal, nil
+	}
+	return equal, nil
+}
+
+func whenEqual(left whenOperand, right whenOperand) bool {
+	if left.isStatus && !right.isStatus {
+		switch right.value {
+		case "success":
+			return left.value == data.StageStatus["SUCCEEDED"]
+		case "failure":
+			return left.value != data.StageStatus["SUCCEEDED"] && left.value != data.StageStatus["SKIPPED"]
+		}
+	}
+	return left.value == right.value
+}
+
+func (p *whenParser) parseOperand() (whenOperand, error) {
+	if p.pos >= len(p.tokens) {
+		return whenOperand{}, fmt.Errorf("unexpected end of condition")
+	}
+
+	var token = p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case "string":
+		return whenOperand{value: token.value}, nil
+	case "env":
+		return whenOperand{value: p.env[token.value]}, nil
+	case "word":
+		reference, isReference := strings.CutPrefix(token.value, "stages.")
+		if !isReference {
+			if !strings.HasSuffix(token.value, ".status") && !strings.HasSuffix(token.value, ".exit_code") {
+				return whenOperand{value: token.value}, nil
+			}
+			// only the stages it depends on can be referenced without the prefix, anything else would be compared as
+			// is and never match what the stage's outcome is
+			var stage = token.value[:strings.LastIndexByte(token.value, '.')]
+			if !slices.Contains(p.dependsOn, stage) {
+				return whenOperand{}, fmt.Errorf("invalid stage reference '%s', '%s' must be listed in depends_on", token.value, stage)
+			}
+		}
+		var stage, field = "", reference
+		if dot := strings.LastIndexByte(reference, '.'); dot != -1 {
+			stage, field = reference[:dot], reference[dot+1:]
+		}
+		if stage == "" || (field != "status" && field != "exit_code") {
+			return whenOperand{}, fmt.Errorf("invalid stage reference '%s', expected stages.NAME.status or stages.NAME.exit_code", token.value)
+		}
+
+		p.refs = append(p.refs, stage)
+		var response = p.stages[stage]
+		if field == "exit_code" {
+			return whenOperand{value: strconv.Itoa(response.ExitCode)}, nil
+		}
+		return whenOperand{value: response.Status, isStatus: true}, nil
+	}
+
+	return whenOperand{}, fmt.Errorf("unexpected '%s'", p.describe(token))
+}
+
+func (p *whenParser) describe(token whenToken) string {
+	if token.value != "" {
+		return token.value
+	}
+	return token.kind
+}
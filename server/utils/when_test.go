@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"pipeline/data"
+	"testing"
+)
+
+func Test_EvaluateWhen_ShouldCompareStageOutcomesEnvAndLiterals(t *testing.T) {
+	// arrange
+	var stages = map[string]data.TaskStatusResponse{
+		"build": {TaskName: "build", Status: data.StageStatus["SUCCEEDED"], ExitCode: 0},
+		"lint":  {TaskName: "lint", Status: data.StageStatus["SKIPPED"], ExitCode: -1},
+		"test":  {TaskName: "test", Status: data.StageStatus["FAILED"], ExitCode: 3},
+		"tags":  {TaskName: "tags", Status: data.StageStatus["FAILED_ALLOWED"], ExitCode: 1},
+	}
+	var env = []string{"MODE=quick", "TARGET=prod", "MODE=full", "VERSION=1.5"}
+	var dependsOn = []string{"build", "lint", "test", "tags"}
+
+	// act & assert
+	var cases = map[string]bool{
+		"stages.build.status == 'success'":                                 true,
+		"stages.build.status == 'succeeded'":                               true,
+		"stages.lint.status == 'success'":                                  false,
+		"stages.lint.status == 'skipped'":                                  true,
+		"stages.test.status == 'failure'":                                  true,
+		"stages.tags.status == 'failure'":                                  true,
+		"stages.test.exit_code == 3":                                       true,
+		"build.status == 'success' && test.exit_code == 3":                 true,
+		"lint.status == 'success'":                                         false,
+		"{env.MODE} == 'full'":                                             true,
+		"{env.MISSING} == ''":                                              true,
+		"'full' == \"full\" && !(stages.build.status != 'success')":        true,
+		"stages.test.status == 'success' || {env.TARGET} == 'prod'":        true,
+		"stages.test.status == 'success' || {env.TARGET} == 'dev' && true": false,
+		"true || false && false":                                           true,
+		"false":                                                            false,
+		"0":                                                                false,
+		"1.5 == '1.5' && v1.2 != 'v1.20'":                                  true,
+		"{env.VERSION} == 1.5":                                             true,
+		"'it\\'s' == \"it's\"":                                             true,
+	}
+	for expression, expected := range cases {
+		result, err := EvaluateWhen(expression, dependsOn, stages, env)
+		if err != nil || result != expected {
+			t.Errorf("EvaluateWhen(%q) = %v, %v, expected %v", expression, result, err, expected)
+		}
+	}
+}
+
+func Test_ParseWhen_ShouldReturnReferencedStages(t *testing.T) {
+	// act
+	references, err := ParseWhen("stages.build.status == 'success' || (stages.test.exit_code != 0 && {env.CI} == 'true')", nil)
+
+	// assert
+	AssertTrue(t, err == nil)
+	AssertSliceEqual(t, []string{"build", "test"}, references)
+}
+
+func Test_ParseWhen_ShouldTreatWordsWithDotsAsLiterals(t *testing.T) {
+	// act
+	references, err := ParseWhen("{env.VERSION} == v1.2 || {env.RATIO} == 1.5 || stages.build.exit_code == 0", []string{"v1"})
+
+	// assert
+	AssertTrue(t, err == nil)
+	AssertSliceEqual(t, []string{"build"}, references)
+}
+
+func Test_ParseWhen_ShouldReturnDependenciesReferencedWithoutThePrefix(t *testing.T) {
+	// act
+	references, err := ParseWhen("transcribe.status == 'success' && 'full' == 'full' || stages.encode.exit_code == 0", []string{"transcribe"})
+
+	// assert
+	AssertTrue(t, err == nil)
+	AssertSliceEqual(t, []string{"transcribe", "encode"}, references)
+}
+
+func Test_ParseWhen_ShouldReturnErrorForInvalidConditions(t *testing.T) {
+	// act & assert
+	for _, expression := range []string{"", "stages.build.status ==", "(a == b", "a == b)", "a = b", "'unterminated", "{HOME} == 'x'",
+		"stages.build.result == 'x'", "stages.status == 'x'", "build.status == 'success'", "a == b &&"} {
+		if _, err := ParseWhen(expression, []string{"test"}); err == nil {
+			t.Errorf("ParseWhen(%q) should return an error", expression)
+		}
+	}
+}
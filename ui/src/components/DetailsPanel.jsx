@@ -8,6 +8,20 @@ import { BackIcon, DocumentIcon } from "../icons";
 
 import EmptyPipelineRuns from "./EmptyPipelineRuns";
 
+// badge (and dot) colours and labels for the run and stage statuses
+const statusStyles = {
+    queued: { label: "Queued", badge: "bg-slate-600/50 text-slate-400 border-slate-500/30", dot: "bg-slate-400" },
+    running: { label: "Running", badge: "bg-amber-500/20 text-amber-400 border-amber-500/30", dot: "bg-amber-500" },
+    succeeded: { label: "Success", badge: "bg-emerald-500/20 text-emerald-400 border-emerald-500/30", dot: "bg-emerald-500" },
+    failed: { label: "Failed", badge: "bg-red-500/20 text-red-400 border-red-500/30", dot: "bg-red-500" },
+    timed_out: { label: "Timed Out", badge: "bg-red-500/20 text-red-400 border-red-500/30", dot: "bg-red-500" },
+    cancelled: { label: "Cancelled", badge: "bg-orange-500/20 text-orange-400 border-orange-500/30", dot: "bg-orange-500" },
+    skipped: { label: "Skipped", badge: "bg-slate-600/50 text-slate-400 border-slate-500/30", dot: "bg-slate-500" },
+    upstream_failed: { label: "Upstream Failed", badge: "bg-slate-600/50 text-red-400 border-slate-500/30", dot: "bg-red-300" },
+    failed_allowed: { label: "Failed (allowed)", badge: "bg-yellow-500/20 text-yellow-400 border-yellow-500/30", dot: "bg-yellow-500" },
+};
+const getStatusStyle = (status) => statusStyles[status] ?? statusStyles.failed;
+
 const DetailsPanel = ({ goBack }) => {
     const [pipelineRuns, setPipelineRuns] = useState([]);
     const { selectedPipeline: pipeline } = useAppContext();
@@ -66,14 +80,13 @@ const DetailsPanel = ({ goBack }) => {
                                             {run.endedAt && ( // if endedAt has value, we can calculate the duration
                                                 <span>Duration: {getDuration(run.startedAt, run.endedAt)}</span>
                                             )}
+                                            {run.warnings > 0 && (
+                                                <span className="text-yellow-400">Warnings: {run.warnings}</span>
+                                            )}
                                         </div>
                                     </div>
-                                    <div className={`px-3 py-1.5 rounded-full text-xs font-medium border ${
-                                        run.successful
-                                            ? "bg-emerald-500/20 text-emerald-400 border-emerald-500/30"
-                                            : "bg-red-500/20 text-red-400 border-red-500/30"
-                                    }`}>
-                                        {run.successful ? "Success" : "Failed"}
+                                    <div className={`px-3 py-1.5 rounded-full text-xs font-medium border ${getStatusStyle(run.status).badge}`}>
+                                        {getStatusStyle(run.status).label}
                                     </div>
                                 </div>
 
@@ -88,18 +101,66 @@ const DetailsPanel = ({ goBack }) => {
                                         {run.stages.map((stage, stageIndex) => (
                                             <div key={stageIndex} className="flex items-center justify-between p-3 bg-slate-700/30 rounded-lg">
                                                 <div className="flex items-center space-x-3">
-                                                    <div className={`w-2 h-2 rounded-full ${stage.skipped ? "bg-slate-500" : stage.successful ?
-                                                        "bg-emerald-500" : "bg-red-500"}`} />
+                                                    <div className={`w-2 h-2 rounded-full ${getStatusStyle(stage.status).dot}`} />
                                                     <span className="text-sm font-medium text-slate-200">
                                                         {stage.taskName}
                                                     </span>
-                                                    <span className={`px-2 py-0.5 rounded text-xs font-medium ${
-                                                        stage.skipped ? "bg-slate-600/50 text-slate-400" : stage.successful ?
-                                                            "bg-emerald-600/20 text-emerald-400" : "bg-red-600/20 text-red-400"}`}>
-                                                        {stage.skipped ? "Skipped" : stage.successful ? "Success" : "Failed"}
+                                                    <span title={stage.error ?? stage.skipReason} className={`px-2 py-0.5 rounded text-xs font-medium ${getStatusStyle(stage.status).badge}`}>
+                                                        {getStatusStyle(stage.status).label}
                                                     </span>
+                                                    {stage.failureReason && (
+                                                        <span className="text-xs text-slate-400">
+                                                            {stage.failureReason.replaceAll("_", " ")}
+                                                            {stage.signal ? ` (${stage.signal})` : stage.exitCode > 0 ? ` (exit ${stage.exitCode})` : ""}
+                                                        </span>
+                                                    )}
+                                                    {stage.lockWaitMs > 0 && (
+                                                        <span className="text-xs text-slate-400">
+                                                            waited {(stage.lockWaitMs / 1000).toFixed(1)}s for locks
+                                                        </span>
+                                                    )}
+                                                    {stage.resourceWaitMs > 0 && (
+                                                        <span className="text-xs text-slate-400">
+                                                            waited {(stage.resourceWaitMs / 1000).toFixed(1)}s for resources
+                                                        </span>
+                                                    )}
+                                                    {stage.usage && (
+                                                        <span className="text-xs text-slate-400"
+                                                            title={`max RSS ${(stage.usage.maxRssKb / 1024).toFixed(0)}MB, ${stage.usage.blockReads} block reads, ${stage.usage.blockWrites} block writes, ${stage.usage.voluntaryContextSwitches + stage.usage.involuntaryContextSwitches} context switches`}>
+                                                            cpu {((stage.usage.userCpuMs + stage.usage.systemCpuMs) / 1000).toFixed(1)}s
+                                                        </span>
+                                                    )}
+                                                    {stage.attempts?.at(-1)?.agent && (
+                                                        <span className="text-xs text-slate-400">
+                                                            on agent {stage.attempts.at(-1).agent}
+                                                        </span>
+                                                    )}
+                                                    {stage.attempts?.at(-1)?.limits && (
+                                                        <span className="text-xs text-slate-400"
+                                                            title={stage.attempts.at(-1).limits.warnings?.join("\n")}>
+                                                            limited, peak {(stage.attempts.at(-1).limits.peakMemoryKb / 1024).toFixed(0)}MB{stage.attempts.at(-1).limits.warnings?.length > 0 ? " (with warnings)" : ""}
+                                                        </span>
+                                                    )}
+                                                    {stage.childRun && (
+                                                        <span className="text-xs text-slate-400" title={`Run ${stage.childRun.id}`}>
+                                                            runs {stage.childRun.pipeline}
+                                                        </span>
+                                                    )}
+                                                    {stage.attempts?.at(-1)?.steps?.length > 0 && (
+                                                        <span className="text-xs text-slate-400"
+                                                            title={stage.attempts.at(-1).steps.map(step => `${step.name}: ${step.error ?? "exit " + step.exitCode}`).join("\n")}>
+                                                            {stage.attempts.at(-1).steps.length} steps
+                                                        </span>
+                                                    )}
+                                                    {stage.artifacts?.map(artifact => (
+                                                        <a key={artifact} title={artifact} download
+                                                            href={`/api/pipelines/${encodeURIComponent(pipeline)}/runs/${run.id}/artifacts?stage=${encodeURIComponent(stage.taskName)}&path=${encodeURIComponent(artifact)}`}
+                                                            className="text-xs text-amber-400 hover:text-amber-300 underline">
+                                                            {artifact.split("/").pop()}
+                                                        </a>
+                                                    ))}
                                                 </div>
-                                                {!stage.skipped && stage.startedAt && stage.endedAt && (
+                                                {stage.attempts?.length > 0 && stage.status !== "running" && (
                                                     <span className="text-xs text-slate-400">
                                                         {getDuration(stage.startedAt, stage.endedAt)}
                                                     </span>